@@ -0,0 +1,78 @@
+package main
+
+import (
+    "bytes"
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "os"
+    "sort"
+    "strings"
+
+    "gopkg.in/yaml.v3"
+)
+
+// Apply a YAML config file whose keys are the flag names, e.g.
+//
+//    measurement-target: both
+//    allowed-registries: [ghcr.io/flashbots/, docker.io/library/]
+//    shutdown-timeout: 30s
+//
+// Flags given on the command line take precedence over the file, the file
+// over the defaults. Lists may be YAML sequences or comma-separated
+// strings. Unknown keys are an error, so a typo doesn't go unnoticed.
+func loadConfigFile(path string) error {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return err
+    }
+    var values map[string]yaml.Node
+    decoder := yaml.NewDecoder(bytes.NewReader(data))
+    if err := decoder.Decode(&values); err != nil && !errors.Is(err, io.EOF) {
+        return fmt.Errorf("failed to parse %s: %v", path, err)
+    }
+
+    keys := make([]string, 0, len(values))
+    for key := range values {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+
+    for _, key := range keys {
+        if key == "config" || flag.Lookup(key) == nil {
+            return fmt.Errorf("%s: unknown option %q", path, key)
+        }
+        node := values[key]
+        value, err := configValue(&node)
+        if err != nil {
+            return fmt.Errorf("%s: %s: %v", path, key, err)
+        }
+        if flagWasSet(key) {
+            continue
+        }
+        if err := flag.Set(key, value); err != nil {
+            return fmt.Errorf("%s: %s: invalid value %q: %v", path, key, value, err)
+        }
+    }
+    return nil
+}
+
+// Flag value of a config file entry: a scalar as written, a sequence of
+// scalars joined with commas
+func configValue(node *yaml.Node) (string, error) {
+    switch node.Kind {
+    case yaml.ScalarNode:
+        return node.Value, nil
+    case yaml.SequenceNode:
+        items := make([]string, len(node.Content))
+        for i, item := range node.Content {
+            if item.Kind != yaml.ScalarNode {
+                return "", errors.New("list items must be scalars")
+            }
+            items[i] = item.Value
+        }
+        return strings.Join(items, ","), nil
+    }
+    return "", errors.New("must be a scalar or a list")
+}
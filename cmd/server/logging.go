@@ -0,0 +1,36 @@
+package main
+
+import (
+    "fmt"
+    "log/slog"
+    "os"
+)
+
+// Install the default slog logger. The standard log package is routed
+// through it as well, so every line ends up in the same format.
+func setupLogging(level, format string) error {
+    var lvl slog.Level
+    if err := lvl.UnmarshalText([]byte(level)); err != nil {
+        return fmt.Errorf("invalid log level %q (want debug, info, warn or error)", level)
+    }
+    opts := &slog.HandlerOptions{Level: lvl}
+
+    var handler slog.Handler
+    switch format {
+    case "json":
+        handler = slog.NewJSONHandler(os.Stderr, opts)
+    case "text":
+        handler = slog.NewTextHandler(os.Stderr, opts)
+    default:
+        return fmt.Errorf("invalid log format %q (want json or text)", format)
+    }
+
+    slog.SetDefault(slog.New(handler))
+    return nil
+}
+
+// Log an error and exit, the slog counterpart of log.Fatalf
+func fatal(msg string, args ...any) {
+    slog.Error(msg, args...)
+    os.Exit(1)
+}
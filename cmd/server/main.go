@@ -1,233 +1,250 @@
 package main
 
 import (
-    "bytes"
+    "context"
+    "flag"
     "fmt"
-    "io"
     "log"
-    "net/http"
+    "log/slog"
     "os"
-    "os/exec"
-    "sync"
+    "os/signal"
+    "strconv"
+    "strings"
     "syscall"
-)
 
-const (
-    podYamlPath = "/tmp/pod.yaml"
-    envFilePath = "/tmp/env"
+    "pod-provisioning-server/provisioner"
 )
 
-// TPM measurement simulation - in real implementation, replace with actual TPM calls
-func measureIntoPCR(filepath string, pcrIndex int) error {
-    // Note: This is a placeholder. Replace with actual TPM measurement code
-    log.Printf("Measuring %s into PCR[%d]", filepath, pcrIndex)
-    return nil
-}
+var defaults = provisioner.DefaultConfig()
 
-// Atomic file write using rename
-func atomicWriteFile(filename string, data []byte) error {
-    tempFile := filename + ".tmp"
-    
-    // Create temp file
-    f, err := os.OpenFile(tempFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
-    if err != nil {
-        return fmt.Errorf("failed to create temp file: %v", err)
-    }
-    defer f.Close()
-    
-    // Write data
-    if _, err := f.Write(data); err != nil {
-        os.Remove(tempFile)
-        return fmt.Errorf("failed to write temp file: %v", err)
-    }
-    
-    // Sync to ensure data is written to disk
-    if err := f.Sync(); err != nil {
-        os.Remove(tempFile)
-        return fmt.Errorf("failed to sync temp file: %v", err)
-    }
-    
-    // Atomic rename
-    if err := os.Rename(tempFile, filename); err != nil {
-        os.Remove(tempFile)
-        return fmt.Errorf("failed to rename temp file: %v", err)
+var (
+    configFile        = flag.String("config", "", "YAML file setting options by flag name, e.g. pcr-hash: sha384; flags on the command line take precedence")
+    checkOnly         = flag.Bool("check", false, "check the runtime, TPM, paths and settings, print a report and exit without serving")
+    measurementTarget = flag.String("measurement-target", defaults.MeasurementTarget, "where to record measurements: pcr, nv or both")
+    nvIndex           = flag.Uint("nv-index", 0, "TPM NV extend index used when the measurement target includes nv, e.g. 0x01500000")
+    tpmDevice         = flag.String("tpm-device", "", "TPM device or simulator socket, e.g. /dev/tpmrm0; without one PCR measurements are only logged")
+    pcrHash           = flag.String("pcr-hash", defaults.PCRHash, "hash algorithm and PCR bank used for measurements: sha1, sha256 or sha384")
+    summaryPCR        = flag.Int("summary-pcr", 0, "PCR extended with a digest over everything provisioned after each /upload and /start, e.g. 16; 0 disables it")
+    measurer          = flag.String("measurer", "", "backend PCR measurements are extended into: tpm, agent or noop; default tpm with -tpm-device, noop without")
+    agentURL          = flag.String("agent-url", "", "attestation agent endpoint measurements are POSTed to with -measurer agent, e.g. http://127.0.0.1:9000/extend")
+    agentSocket       = flag.String("agent-socket", "", "Unix socket to reach the attestation agent over instead of TCP; -agent-url then only supplies the path")
+    logLevel          = flag.String("log-level", "info", "log level: debug, info, warn or error")
+    logFormat         = flag.String("log-format", "json", "log format: json or text")
+    runtimeName       = flag.String("runtime", defaults.Runtime, "container runtime: podman or docker-compose")
+    dockerBin         = flag.String("docker-bin", defaults.DockerBin, "docker binary used by the docker-compose runtime")
+    dryRun            = flag.Bool("dry-run", false, "measure uploads but only report what /start would run, without running it or shutting down")
+    startRetries      = flag.Int("start-retries", 0, "how often to retry a failed container start, e.g. after an image pull failure")
+    startRetryDelay   = flag.Duration("start-retry-delay", defaults.StartRetryDelay, "delay before the first start retry, doubled after each attempt")
+    startCgroup       = flag.String("start-cgroup", "", "cgroup v2 directory the start command is created in, e.g. /sys/fs/cgroup/workload; empty keeps it in the provisioner's")
+    startOOMScoreAdj  = flag.Int("start-oom-score-adj", 0, "oom_score_adj of the start command, -1000 to 1000; inherited from the provisioner unless given")
+    podmanBin         = flag.String("podman-bin", defaults.PodmanBin, "podman binary, looked up in PATH unless it contains a slash")
+    maxUploadBytes    = flag.Int64("max-upload-bytes", defaults.MaxUploadBytes, "maximum size of an /upload request body in bytes")
+    fetchTimeout      = flag.Duration("fetch-timeout", defaults.FetchTimeout, "timeout for fetching a manifest given as pod_url")
+    resumableTTL      = flag.Duration("resumable-upload-ttl", defaults.ResumableUploadTTL, "how long an unfinished resumable upload is kept without receiving a chunk")
+    tempDir           = flag.String("temp-dir", "", "directory for the temp files of atomic writes, used for targets on the same filesystem; empty keeps them next to the target")
+    renameRetries     = flag.Int("rename-retries", defaults.RenameRetries, "how often to retry a rename that failed with a transient error")
+    renameRetryErrnos = flag.String("rename-retry-errnos", strings.Join(defaults.RenameRetryErrnos, ","), "comma-separated errno names treated as transient on rename")
+    listenAddr        = flag.String("listen", defaults.ListenAddr, "TCP address to listen on")
+    unixSocket        = flag.String("unix-socket", "", "listen on this Unix socket instead of TCP")
+    authToken         = flag.String("auth-token", "", "bearer token required by all endpoints but /healthz and /version, or @/path/to/file to read it from; re-read on SIGHUP")
+    registryAllowlist = flag.String("allowed-registries", "", "comma-separated image prefixes, e.g. ghcr.io/flashbots/; when set, /upload rejects manifests with images from anywhere else")
+    maxDocuments      = flag.Int("max-documents", defaults.MaxDocuments, "maximum number of YAML documents across the manifests of an upload")
+    allowedKinds      = flag.String("allowed-kinds", strings.Join(defaults.AllowedKinds, ","), "comma-separated kinds manifest documents may have with the podman runtime; empty allows any")
+    healthTimeout     = flag.Duration("healthcheck-timeout", 0, "after /start, wait up to this long for containers with a HEALTHCHECK to pass before shutting down; 0 disables (podman only)")
+    healthInterval    = flag.Duration("healthcheck-interval", defaults.HealthcheckInterval, "delay between healthcheck runs while waiting for -healthcheck-timeout")
+    idempotencyTTL    = flag.Duration("idempotency-ttl", defaults.IdempotencyTTL, "how long a /start response is replayed to retries with the same Idempotency-Key")
+    corsOrigins       = flag.String("cors-origins", "", "comma-separated origins allowed to call the API from a browser, e.g. https://admin.example.com")
+    h2cEnabled        = flag.Bool("h2c", false, "also serve HTTP/2 over cleartext (h2c), for deployments terminating TLS elsewhere")
+    measureDir        = flag.String("measure-dir", "", "directory POST /measure writes extra files to before measuring them; empty disables /measure")
+    secretsPath       = flag.String("secrets-path", "", "tmpfs path an uploaded secrets file is written to, e.g. /dev/shm/pod-secrets; empty rejects secrets")
+    secretsPCR        = flag.Int("secrets-pcr", defaults.SecretsPCR, "PCR the secrets file is measured into")
+    registryAuthDir   = flag.String("registry-auth-dir", defaults.RegistryAuthDir, "tmpfs directory the registry credentials of a /pull are written to while podman pulls")
+    podModeFlag       = flag.String("pod-mode", "0600", "octal mode of the written pod manifests and envelopes")
+    envModeFlag       = flag.String("env-mode", "0600", "octal mode of the written env file")
+    rateLimitRate     = flag.Float64("rate-limit", 0, "requests per second allowed to the endpoints using the TPM or the runtime, like /upload and /start, combined; 0 disables rate limiting")
+    rateBurst         = flag.Int("rate-burst", defaults.RateBurst, "how many requests -rate-limit lets through at once")
+    readHeaderTimeout = flag.Duration("read-header-timeout", defaults.ReadHeaderTimeout, "how long a client may take to send request headers; 0 disables the timeout")
+    readTimeout       = flag.Duration("read-timeout", defaults.ReadTimeout, "how long a client may take to send a whole request, body included; 0 disables the timeout")
+    writeTimeout      = flag.Duration("write-timeout", defaults.WriteTimeout, "how long writing a response may take, except for /events, /start, /pull and /validate; 0 disables the timeout")
+    idleTimeout       = flag.Duration("idle-timeout", defaults.IdleTimeout, "how long an idle keep-alive connection is kept open; 0 falls back to -read-timeout")
+    shutdownTimeout   = flag.Duration("shutdown-timeout", defaults.ShutdownTimeout, "how long shutdown waits for in-flight requests before closing their connections")
+    provisionDeadline = flag.Duration("provision-deadline", 0, "exit with an error if no /start succeeds this long after startup; 0 waits forever")
+    teardownOnExit    = flag.Bool("teardown-on-exit", false, "tear down the started pod when the server exits, instead of leaving it running")
+    teardownTimeout   = flag.Duration("teardown-timeout", defaults.TeardownTimeout, "how long -teardown-on-exit waits for the runtime to stop the pod")
+    envelopeKeysFile  = flag.String("envelope-keys", "", "PEM file with public keys; when set, pod manifests must be DSSE envelopes signed by one of them")
+)
+
+// Parse an octal permission flag value like 0640
+func parseFileMode(value string) (os.FileMode, error) {
+    mode, err := strconv.ParseUint(value, 8, 32)
+    if err != nil || mode > 0777 {
+        return 0, fmt.Errorf("invalid file mode %q (want octal permission bits, e.g. 0640)", value)
     }
-    
-    return nil
+    return os.FileMode(mode), nil
 }
 
-// Check if a file exists
-func fileExists(filename string) bool {
-    _, err := os.Stat(filename)
-    return err == nil
+// Split a comma-separated flag value, dropping empty entries
+func splitList(value string) []string {
+    var items []string
+    for _, item := range strings.Split(value, ",") {
+        if item = strings.TrimSpace(item); item != "" {
+            items = append(items, item)
+        }
+    }
+    return items
 }
 
-func main() {
-    var wg sync.WaitGroup
-    shutdownCh := make(chan struct{})
-    
-    // File upload handler
-    http.HandleFunc("/upload", func(w http.ResponseWriter, r *http.Request) {
-        if r.Method != http.MethodPost {
-            http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-            return
-        }
-        
-        // Parse multipart form
-        err := r.ParseMultipartForm(10 << 20) // 10 MB limit
-        if err != nil {
-            http.Error(w, "Failed to parse form", http.StatusBadRequest)
-            return
-        }
-        
-        // Handle pod.yaml
-        podFile, _, err := r.FormFile("pod.yaml")
-        if err != nil {
-            http.Error(w, "pod.yaml is required", http.StatusBadRequest)
-            return
+// Whether a flag was given on the command line or in the config file, as
+// opposed to defaulted
+func flagWasSet(name string) bool {
+    set := false
+    flag.Visit(func(f *flag.Flag) {
+        if f.Name == name {
+            set = true
         }
-        defer podFile.Close()
-        
-        // Check if pod.yaml already exists
-        if fileExists(podYamlPath) {
-            http.Error(w, "pod.yaml already exists", http.StatusConflict)
-            return
-        }
-        
-        // Read pod.yaml content
-        podContent, err := io.ReadAll(podFile)
-        if err != nil {
-            http.Error(w, "Failed to read pod.yaml", http.StatusInternalServerError)
-            return
-        }
-        
-        // Handle optional env file
-        var envContent []byte
-        if envFile, _, err := r.FormFile("env"); err == nil {
-            defer envFile.Close()
-            
-            // Check if env already exists
-            if fileExists(envFilePath) {
-                http.Error(w, "env already exists", http.StatusConflict)
-                return
-            }
-            
-            envContent, err = io.ReadAll(envFile)
-            if err != nil {
-                http.Error(w, "Failed to read env", http.StatusInternalServerError)
-                return
-            }
-        }
-        
-        // Atomic write of pod.yaml
-        if err := atomicWriteFile(podYamlPath, podContent); err != nil {
-            http.Error(w, fmt.Sprintf("Failed to write pod.yaml: %v", err), http.StatusInternalServerError)
-            return
-        }
-        
-        // Measure pod.yaml into PCR[13]
-        if err := measureIntoPCR(podYamlPath, 13); err != nil {
-            http.Error(w, "Failed to measure pod.yaml", http.StatusInternalServerError)
-            return
-        }
-        
-        // If env was provided, write it atomically and measure it
-        if len(envContent) > 0 {
-            if err := atomicWriteFile(envFilePath, envContent); err != nil {
-                http.Error(w, fmt.Sprintf("Failed to write env: %v", err), http.StatusInternalServerError)
-                return
-            }
-            
-            // Measure env into PCR[14]
-            if err := measureIntoPCR(envFilePath, 14); err != nil {
-                http.Error(w, "Failed to measure env", http.StatusInternalServerError)
-                return
-            }
-        }
-        
-        w.WriteHeader(http.StatusCreated)
     })
-    
-    // Start container handler
-    http.HandleFunc("/start", func(w http.ResponseWriter, r *http.Request) {
-        if r.Method != http.MethodPost {
-            http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-            return
-        }
-        
-        // Check if required files exist
-        if !fileExists(podYamlPath) {
-            http.Error(w, "pod.yaml not found", http.StatusNotFound)
-            return
-        }
-        
-        // Prepare command
-        var cmd *exec.Cmd
-        if fileExists(envFilePath) {
-            // Start with environment file
-            cmd = exec.Command("sh", "-c", fmt.Sprintf(". %s && podman play kube %s", envFilePath, podYamlPath))
-        } else {
-            // Start without environment file
-            cmd = exec.Command("podman", "play", "kube", podYamlPath)
-        }
+    return set
+}
 
-        // Check if podman is installed
-        if _, err := exec.LookPath("podman"); err != nil {
-            http.Error(w, "podman is not installed", http.StatusInternalServerError)
-            return
+// Print one line per startup check, returning the exit code: 1 if any
+// check failed
+func printCheckReport(results []provisioner.CheckResult) int {
+    code := 0
+    for _, result := range results {
+        switch {
+        case result.Err != nil:
+            code = 1
+            fmt.Printf("FAIL %-8s %s\n", result.Name, strings.ReplaceAll(result.Err.Error(), "\n", "; "))
+        case result.Detail != "":
+            fmt.Printf("ok   %-8s %s\n", result.Name, result.Detail)
+        default:
+            fmt.Printf("ok   %s\n", result.Name)
         }
+    }
+    return code
+}
 
-        // Create buffers for output
-        var stdout, stderr bytes.Buffer
-        cmd.Stdout = &stdout
-        cmd.Stderr = &stderr
-        
-        // Set process group ID to ensure child processes survive
-        cmd.SysProcAttr = &syscall.SysProcAttr{
-            Setpgid: true,
-        }
-        
-	// Execute command and wait for completion
-        err := cmd.Run()  // Run() combines Start() and Wait()
-        if err != nil {
-            errorMsg := fmt.Sprintf("Container start failed:\nStdout: %s\nStderr: %s\nError: %v",
-                stdout.String(),
-                stderr.String(),
-                err)
-            log.Printf("Error starting container: %s", errorMsg)
-            http.Error(w, errorMsg, http.StatusInternalServerError)
-	    // we could shutdown the server here, but I don't see any benefits
-            return
+func main() {
+    flag.Parse()
+    if *configFile != "" {
+        if err := loadConfigFile(*configFile); err != nil {
+            log.Fatalf("Invalid config file: %v", err)
         }
+    }
 
-        log.Printf("Container started successfully. Output: %s", stdout.String())
-        
-        // Trigger server shutdown
-        close(shutdownCh)
-        w.WriteHeader(http.StatusOK)
-    })
-    
-    // Start server
-    server := &http.Server{
-        Addr: ":24070",
+    if err := setupLogging(*logLevel, *logFormat); err != nil {
+        log.Fatalf("Invalid logging configuration: %v", err)
+    }
+
+    // TCP and Unix socket listening are mutually exclusive
+    if *unixSocket != "" && flagWasSet("listen") {
+        fatal("-listen and -unix-socket are mutually exclusive")
+    }
+    if *nvIndex > 0xffffffff {
+        fatal("Invalid -nv-index", "nv_index", *nvIndex)
+    }
+
+    // Modes of the files written by /upload
+    podMode, err := parseFileMode(*podModeFlag)
+    if err != nil {
+        fatal("Invalid -pod-mode", "error", err)
     }
-    
-    // Handle graceful shutdown
-    wg.Add(1)
+    envMode, err := parseFileMode(*envModeFlag)
+    if err != nil {
+        fatal("Invalid -env-mode", "error", err)
+    }
+
+    cfg := provisioner.Config{
+        MeasurementTarget:   *measurementTarget,
+        NVIndex:             uint32(*nvIndex),
+        TPMDevice:           *tpmDevice,
+        PCRHash:             *pcrHash,
+        SummaryPCR:          *summaryPCR,
+        Measurer:            *measurer,
+        AgentURL:            *agentURL,
+        AgentSocket:         *agentSocket,
+        Runtime:             *runtimeName,
+        PodmanBin:           *podmanBin,
+        DockerBin:           *dockerBin,
+        DryRun:              *dryRun,
+        StartRetries:        *startRetries,
+        StartRetryDelay:     *startRetryDelay,
+        HealthcheckTimeout:  *healthTimeout,
+        HealthcheckInterval: *healthInterval,
+        IdempotencyTTL:      *idempotencyTTL,
+        StartCgroup:         *startCgroup,
+        MaxUploadBytes:      *maxUploadBytes,
+        FetchTimeout:        *fetchTimeout,
+        ResumableUploadTTL:  *resumableTTL,
+        AllowedRegistries:   splitList(*registryAllowlist),
+        MaxDocuments:        *maxDocuments,
+        AllowedKinds:        splitList(*allowedKinds),
+        EnvelopeKeysFile:    *envelopeKeysFile,
+        ManifestDir:         defaults.ManifestDir,
+        EnvPath:             defaults.EnvPath,
+        StatePath:           defaults.StatePath,
+        EventLogPath:        defaults.EventLogPath,
+        AuditLogPath:        defaults.AuditLogPath,
+        MeasureDir:          *measureDir,
+        SecretsPath:         *secretsPath,
+        SecretsPCR:          *secretsPCR,
+        RegistryAuthDir:     *registryAuthDir,
+        PodMode:             podMode,
+        EnvMode:             envMode,
+        TempDir:             *tempDir,
+        RenameRetries:       *renameRetries,
+        RenameRetryErrnos:   splitList(*renameRetryErrnos),
+        ListenAddr:          *listenAddr,
+        UnixSocket:          *unixSocket,
+        AuthToken:           *authToken,
+        CORSOrigins:         splitList(*corsOrigins),
+        H2C:                 *h2cEnabled,
+        RateLimit:           *rateLimitRate,
+        RateBurst:           *rateBurst,
+        ReadHeaderTimeout:   *readHeaderTimeout,
+        ReadTimeout:         *readTimeout,
+        WriteTimeout:        *writeTimeout,
+        IdleTimeout:         *idleTimeout,
+        ShutdownTimeout:     *shutdownTimeout,
+        ProvisionDeadline:   *provisionDeadline,
+        TeardownOnExit:      *teardownOnExit,
+        TeardownTimeout:     *teardownTimeout,
+    }
+    if flagWasSet("start-oom-score-adj") {
+        cfg.StartOOMScoreAdj = startOOMScoreAdj
+    }
+    if *checkOnly {
+        os.Exit(printCheckReport(provisioner.Check(cfg)))
+    }
+    server, err := provisioner.New(cfg)
+    if err != nil {
+        fatal("Failed to set up provisioner", "error", err)
+    }
+
+    // Shut down on SIGINT/SIGTERM, reload the auth token on SIGHUP
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    signalCh := make(chan os.Signal, 1)
+    signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
     go func() {
-        defer wg.Done()
-        <-shutdownCh
-        log.Println("Shutting down server...")
-        server.Close()
+        for sig := range signalCh {
+            if sig == syscall.SIGHUP {
+                if *authToken == "" {
+                    continue
+                }
+                if err := server.ReloadAuthToken(); err != nil {
+                    slog.Error("Failed to reload auth token, keeping the previous one", "error", err)
+                    continue
+                }
+                slog.Info("Reloaded auth token")
+                continue
+            }
+            slog.Info("Received signal", "signal", sig.String())
+            cancel()
+        }
     }()
-    
-    // Start the server
-    log.Println("Server starting on :8080")
-    if err := server.ListenAndServe(); err != http.ErrServerClosed {
-        log.Fatalf("Server error: %v", err)
+
+    if err := server.Run(ctx); err != nil {
+        fatal("Server error", "error", err)
     }
-    
-    // Wait for shutdown to complete
-    wg.Wait()
-    log.Println("Server shutdown complete")
 }
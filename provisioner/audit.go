@@ -0,0 +1,150 @@
+package provisioner
+
+import (
+    "bufio"
+    "bytes"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io/fs"
+    "net/http"
+    "os"
+    "sync"
+    "time"
+)
+
+// One line of the audit log, an operational record of an uploaded file.
+// Prev is the SHA-256 of the line before it, so editing or dropping an
+// entry breaks the chain. The secrets file is recorded without its SHA-256,
+// which would let anyone reading the log check guesses of the secrets.
+type auditEntry struct {
+    Time       string `json:"time"`
+    Path       string `json:"path"`
+    Bytes      int    `json:"bytes"`
+    SHA256     string `json:"sha256,omitempty"`
+    PCR        int    `json:"pcr"`
+    RemoteAddr string `json:"remote_addr"`
+    Prev       string `json:"prev"`
+}
+
+// Append-only audit log of every successful upload
+type auditLog struct {
+    mu   sync.Mutex
+    path string
+    // Path of the secrets file, empty if there is none
+    secretsPath string
+    // SHA-256 of the last line written
+    prev string
+}
+
+// Open the audit log at path, picking up the chain where it ended
+func openAuditLog(path, secretsPath string) (*auditLog, error) {
+    a := &auditLog{path: path, secretsPath: secretsPath}
+    data, err := os.ReadFile(path)
+    if errors.Is(err, fs.ErrNotExist) {
+        return a, nil
+    }
+    if err != nil {
+        return nil, fmt.Errorf("failed to read audit log: %v", err)
+    }
+    if lines := bytes.Split(bytes.TrimRight(data, "\n"), []byte("\n")); len(lines[len(lines)-1]) > 0 {
+        digest := sha256.Sum256(lines[len(lines)-1])
+        a.prev = hex.EncodeToString(digest[:])
+    }
+    return a, nil
+}
+
+// Record the files of an upload, all in a single synced append
+func (a *auditLog) record(files []measuredFile, remoteAddr string) error {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+
+    now := time.Now().UTC().Format(time.RFC3339)
+    prev := a.prev
+    var buf bytes.Buffer
+    for _, f := range files {
+        data, err := os.ReadFile(f.path)
+        if err != nil {
+            return fmt.Errorf("failed to read %s: %v", f.path, err)
+        }
+        entry := auditEntry{
+            Time:       now,
+            Path:       f.path,
+            Bytes:      len(data),
+            PCR:        f.pcr,
+            RemoteAddr: remoteAddr,
+            Prev:       prev,
+        }
+        if f.path != a.secretsPath {
+            digest := sha256.Sum256(data)
+            entry.SHA256 = hex.EncodeToString(digest[:])
+        }
+        line, err := json.Marshal(entry)
+        if err != nil {
+            return fmt.Errorf("failed to encode audit entry: %v", err)
+        }
+        buf.Write(line)
+        buf.WriteByte('\n')
+        lineDigest := sha256.Sum256(line)
+        prev = hex.EncodeToString(lineDigest[:])
+    }
+
+    f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+    if err != nil {
+        return fmt.Errorf("failed to open audit log: %v", err)
+    }
+    defer f.Close()
+    if _, err := f.Write(buf.Bytes()); err != nil {
+        return fmt.Errorf("failed to write audit log: %v", err)
+    }
+    if err := f.Sync(); err != nil {
+        return fmt.Errorf("failed to sync audit log: %v", err)
+    }
+    a.prev = prev
+    return nil
+}
+
+// All entries of the audit log, oldest first
+func (a *auditLog) entries() ([]auditEntry, error) {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+
+    entries := []auditEntry{}
+    f, err := os.Open(a.path)
+    if errors.Is(err, fs.ErrNotExist) {
+        return entries, nil
+    }
+    if err != nil {
+        return nil, fmt.Errorf("failed to open audit log: %v", err)
+    }
+    defer f.Close()
+
+    scanner := bufio.NewScanner(f)
+    for scanner.Scan() {
+        var entry auditEntry
+        if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+            return nil, fmt.Errorf("failed to parse audit log: %v", err)
+        }
+        entries = append(entries, entry)
+    }
+    if err := scanner.Err(); err != nil {
+        return nil, fmt.Errorf("failed to read audit log: %v", err)
+    }
+    return entries, nil
+}
+
+// Audit log handler, listing every recorded upload
+func (s *Server) handleAudit(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    entries, err := s.audit.entries()
+    if err != nil {
+        writeError(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    writeJSON(w, http.StatusOK, entries)
+}
@@ -0,0 +1,78 @@
+package provisioner
+
+import (
+    "crypto/subtle"
+    "errors"
+    "fmt"
+    "net/http"
+    "os"
+    "strings"
+    "sync"
+)
+
+// Paths reachable without a token, so probes don't need the secret
+var unauthenticatedPaths = map[string]bool{
+    "/healthz": true,
+    "/version": true,
+}
+
+// Bearer token required by every request, reloadable at runtime. The
+// configured value is either the token itself or @/path/to/file.
+type tokenStore struct {
+    mu     sync.RWMutex
+    source string
+    token  string
+}
+
+func newTokenStore(source string) (*tokenStore, error) {
+    s := &tokenStore{source: source}
+    if err := s.reload(); err != nil {
+        return nil, err
+    }
+    return s, nil
+}
+
+// Re-read the token from its source, keeping the old one on failure
+func (s *tokenStore) reload() error {
+    token := s.source
+    if path, ok := strings.CutPrefix(s.source, "@"); ok {
+        data, err := os.ReadFile(path)
+        if err != nil {
+            return fmt.Errorf("failed to read token file: %v", err)
+        }
+        token = strings.TrimSpace(string(data))
+    }
+    if token == "" {
+        return errors.New("auth token is empty")
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.token = token
+    return nil
+}
+
+func (s *tokenStore) get() string {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    return s.token
+}
+
+// Middleware rejecting requests without the current bearer token. The
+// token is read once per request, so a reload doesn't affect requests
+// already past this check.
+func requireToken(tokens *tokenStore, next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if unauthenticatedPaths[r.URL.Path] {
+            next.ServeHTTP(w, r)
+            return
+        }
+        given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+        if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(tokens.get())) != 1 {
+            w.Header().Set("WWW-Authenticate", "Bearer")
+            writeError(w, "Unauthorized", http.StatusUnauthorized)
+            return
+        }
+        next.ServeHTTP(w, r)
+    })
+}
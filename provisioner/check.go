@@ -0,0 +1,273 @@
+package provisioner
+
+import (
+    "errors"
+    "fmt"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "slices"
+    "strings"
+
+    "github.com/google/go-tpm/tpm2"
+    "github.com/google/go-tpm/tpm2/transport"
+)
+
+// Outcome of one startup check. Detail says what was found when it passed.
+type CheckResult struct {
+    Name   string
+    Detail string
+    Err    error
+}
+
+// What the checks found out probing the environment, so New uses it
+// rather than running podman and querying the TPM a second time
+type checkedEnv struct {
+    // Absolute path of the runtime binary, the configured name if it
+    // wasn't found in dry-run mode
+    runtimePath string
+    // Form of podman's play subcommand, nil unless the podman binary was
+    // found
+    podmanPlay []string
+    // Open TPM, nil without a TPM device, and the PCRs allocated in the
+    // selected bank if they were checked
+    tpm  transport.TPMCloser
+    bank []byte
+}
+
+// Close what the checks left open
+func (env *checkedEnv) close() {
+    if env.tpm != nil {
+        env.tpm.Close()
+        env.tpm = nil
+    }
+}
+
+// Verify the environment cfg needs before serving anything: the settings
+// themselves, the runtime binary, the TPM and the directories written to.
+// Every check runs, so a report lists all problems at once. New refuses
+// to start if any of them fails.
+func Check(cfg Config) []CheckResult {
+    results, env := runChecks(cfg)
+    env.close()
+    return results
+}
+
+// Run the checks of Check, returning what they resolved along with the
+// report. The caller has to close the returned env.
+func runChecks(cfg Config) ([]CheckResult, *checkedEnv) {
+    checks := []struct {
+        name  string
+        check func(Config, *checkedEnv) (string, error)
+    }{
+        {"config", checkConfig},
+        {"runtime", checkRuntime},
+        {"tpm", checkTPM},
+        {"paths", checkPaths},
+    }
+    env := &checkedEnv{}
+    results := make([]CheckResult, len(checks))
+    for i, c := range checks {
+        detail, err := c.check(cfg, env)
+        results[i] = CheckResult{Name: c.name, Detail: detail, Err: err}
+    }
+    return results, env
+}
+
+// The failed checks of a report as one error, nil if all passed
+func checkFailures(results []CheckResult) error {
+    var errs []error
+    for _, result := range results {
+        if result.Err != nil {
+            errs = append(errs, fmt.Errorf("%s: %v", result.Name, result.Err))
+        }
+    }
+    return errors.Join(errs...)
+}
+
+// Values that are invalid whatever the environment
+func checkConfig(cfg Config, _ *checkedEnv) (string, error) {
+    var errs []error
+    if cfg.MaxUploadBytes <= 0 {
+        errs = append(errs, fmt.Errorf("invalid max upload bytes %d, must be positive", cfg.MaxUploadBytes))
+    }
+    if cfg.MaxDocuments <= 0 {
+        errs = append(errs, fmt.Errorf("invalid max documents %d, must be positive", cfg.MaxDocuments))
+    }
+    if cfg.RateLimit > 0 && cfg.RateBurst < 1 {
+        errs = append(errs, fmt.Errorf("invalid rate burst %d, must be at least 1", cfg.RateBurst))
+    }
+    if cfg.IdempotencyTTL <= 0 {
+        errs = append(errs, fmt.Errorf("invalid idempotency TTL %v, must be positive", cfg.IdempotencyTTL))
+    }
+    if cfg.ResumableUploadTTL <= 0 {
+        errs = append(errs, fmt.Errorf("invalid resumable upload TTL %v, must be positive", cfg.ResumableUploadTTL))
+    }
+    paths := []struct{ name, path string }{
+        {"manifest dir", cfg.ManifestDir},
+        {"env path", cfg.EnvPath},
+        {"state path", cfg.StatePath},
+        {"event log path", cfg.EventLogPath},
+        {"audit log path", cfg.AuditLogPath},
+    }
+    for _, p := range paths {
+        if p.path == "" {
+            errs = append(errs, fmt.Errorf("no %s set", p.name))
+        }
+    }
+    if cfg.Runtime != "podman" && cfg.Runtime != "docker-compose" {
+        errs = append(errs, fmt.Errorf("invalid runtime %q (want podman or docker-compose)", cfg.Runtime))
+    }
+
+    pcrTarget, _, err := parseMeasurementTarget(cfg.MeasurementTarget)
+    if err != nil {
+        errs = append(errs, err)
+    }
+    if _, ok := pcrHashAlgorithms[cfg.PCRHash]; !ok {
+        errs = append(errs, fmt.Errorf("invalid PCR hash %q (want sha1, sha256 or sha384)", cfg.PCRHash))
+    }
+    if cfg.SummaryPCR != 0 {
+        if err == nil && !pcrTarget {
+            errs = append(errs, fmt.Errorf("a summary PCR needs measurement target pcr or both, not %s", cfg.MeasurementTarget))
+        }
+        if err := validateExtraPCR(cfg.SummaryPCR); err != nil {
+            errs = append(errs, fmt.Errorf("invalid summary PCR: %v", err))
+        } else if cfg.SecretsPath != "" && cfg.SummaryPCR == cfg.SecretsPCR {
+            errs = append(errs, fmt.Errorf("invalid summary PCR: PCR %d is used for secrets", cfg.SummaryPCR))
+        }
+    }
+    if cfg.SecretsPath != "" {
+        if err := validateExtraPCR(cfg.SecretsPCR); err != nil {
+            errs = append(errs, fmt.Errorf("invalid secrets PCR: %v", err))
+        }
+    }
+    return "", errors.Join(errs...)
+}
+
+// The runtime binary can be found and, for podman, plays manifests in a
+// form we know, unless nothing is run anyway
+func checkRuntime(cfg Config, env *checkedEnv) (string, error) {
+    bin := cfg.PodmanBin
+    if cfg.Runtime == "docker-compose" {
+        bin = cfg.DockerBin
+    } else if cfg.Runtime != "podman" {
+        return "", errors.New("no valid runtime selected")
+    }
+    path, err := exec.LookPath(bin)
+    if err != nil && cfg.DryRun {
+        env.runtimePath = bin
+        return fmt.Sprintf("%s not found, not needed in dry-run mode", bin), nil
+    } else if err != nil {
+        return "", fmt.Errorf("%s not found: %v", bin, err)
+    }
+    env.runtimePath = path
+    // Detected in dry-run mode too, so a dry run reports the command a real
+    // run would use
+    if cfg.Runtime == "podman" {
+        play, err := detectPodmanPlay(path)
+        if err != nil {
+            return "", err
+        }
+        env.podmanPlay = play
+        return fmt.Sprintf("%s, %s", path, strings.Join(play, " ")), nil
+    }
+    return path, nil
+}
+
+// The TPM device opens and has what the measurements need: the measured
+// PCRs allocated in the selected bank and the NV index
+func checkTPM(cfg Config, env *checkedEnv) (string, error) {
+    if cfg.TPMDevice == "" {
+        if cfg.Measurer == "tpm" {
+            return "", errors.New("a TPM device is required for measurer tpm")
+        }
+        return "no TPM device", nil
+    }
+    tpm, err := openTPM(cfg.TPMDevice)
+    if err != nil {
+        return "", err
+    }
+    // Kept open for New, closed by whoever ran the checks
+    env.tpm = tpm
+
+    pcrTarget, nvTarget, _ := parseMeasurementTarget(cfg.MeasurementTarget)
+    hashAlg, ok := pcrHashAlgorithms[cfg.PCRHash]
+    if pcrTarget && ok && (cfg.Measurer == "" || cfg.Measurer == "tpm") {
+        env.bank, err = checkPCRBank(tpm, cfg, hashAlg.alg)
+        if err != nil {
+            return "", err
+        }
+    }
+    if nvTarget && cfg.NVIndex != 0 {
+        if err := validateNVIndex(tpm, cfg.NVIndex); err != nil {
+            return "", err
+        }
+    }
+    return cfg.TPMDevice, nil
+}
+
+// The bank of alg, checked to have every PCR measured into allocated
+func checkPCRBank(tpm transport.TPM, cfg Config, alg tpm2.TPMAlgID) ([]byte, error) {
+    bank, err := pcrBank(tpm, alg)
+    if err != nil {
+        return nil, fmt.Errorf("unsupported PCR hash %s: %v", cfg.PCRHash, err)
+    }
+    pcrs := []int{podPCR, envPCR}
+    if cfg.SummaryPCR != 0 {
+        pcrs = append(pcrs, cfg.SummaryPCR)
+    }
+    if cfg.SecretsPath != "" {
+        pcrs = append(pcrs, cfg.SecretsPCR)
+    }
+    for _, pcr := range pcrs {
+        if !pcrSelected(bank, pcr) {
+            return nil, fmt.Errorf("PCR %d is not allocated in the %s bank", pcr, cfg.PCRHash)
+        }
+    }
+    return bank, nil
+}
+
+// Every directory the server writes to exists and is writable, and the
+// secrets one is on tmpfs
+func checkPaths(cfg Config, _ *checkedEnv) (string, error) {
+    dirs := []string{cfg.ManifestDir, filepath.Dir(cfg.EnvPath), filepath.Dir(cfg.StatePath), filepath.Dir(cfg.EventLogPath), filepath.Dir(cfg.AuditLogPath)}
+    for _, dir := range []string{cfg.MeasureDir, cfg.TempDir} {
+        if dir != "" {
+            dirs = append(dirs, dir)
+        }
+    }
+    for _, path := range []string{cfg.SecretsPath, cfg.UnixSocket} {
+        if path != "" {
+            dirs = append(dirs, filepath.Dir(path))
+        }
+    }
+
+    var errs []error
+    var checked []string
+    for _, dir := range dirs {
+        if slices.Contains(checked, dir) {
+            continue
+        }
+        checked = append(checked, dir)
+        if err := checkWritableDir(dir); err != nil {
+            errs = append(errs, err)
+        }
+    }
+    if cfg.SecretsPath != "" {
+        if err := checkTmpfs(cfg.SecretsPath); err != nil {
+            errs = append(errs, fmt.Errorf("invalid secrets path %s: %v", cfg.SecretsPath, err))
+        }
+    }
+    return strings.Join(checked, ", "), errors.Join(errs...)
+}
+
+// Create and remove a file in dir, the only reliable way of telling it's
+// writable by us
+func checkWritableDir(dir string) error {
+    f, err := os.CreateTemp(dir, ".provisioner-check-*")
+    if err != nil {
+        return fmt.Errorf("%s is not writable: %v", dir, err)
+    }
+    f.Close()
+    return os.Remove(f.Name())
+}
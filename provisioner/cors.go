@@ -0,0 +1,43 @@
+package provisioner
+
+import (
+    "net/http"
+)
+
+// Headers a browser client may send, Authorization for the auth token,
+// Idempotency-Key for retrying /start and Content-Range for the chunks of
+// a resumable upload
+const corsAllowedHeaders = "Authorization, Content-Type, Content-Encoding, Content-Range, Idempotency-Key"
+
+// PUT and DELETE are only used below /upload/, for resumable uploads
+const corsAllowedMethods = "GET, POST, PUT, DELETE, OPTIONS"
+
+// Middleware adding CORS headers for requests from one of the allowed
+// origins and answering their preflight requests. It sits in front of
+// requireToken, since browsers send preflights without credentials.
+// Requests from other origins pass through untouched.
+func allowCORS(origins []string, next http.Handler) http.Handler {
+    allowed := make(map[string]bool, len(origins))
+    for _, origin := range origins {
+        allowed[origin] = true
+    }
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        origin := r.Header.Get("Origin")
+        w.Header().Add("Vary", "Origin")
+        if origin == "" || !allowed[origin] {
+            next.ServeHTTP(w, r)
+            return
+        }
+
+        w.Header().Set("Access-Control-Allow-Origin", origin)
+        w.Header().Set("Access-Control-Allow-Credentials", "true")
+        if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+            w.Header().Set("Access-Control-Allow-Methods", corsAllowedMethods)
+            w.Header().Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+            w.Header().Set("Access-Control-Max-Age", "600")
+            w.WriteHeader(http.StatusNoContent)
+            return
+        }
+        next.ServeHTTP(w, r)
+    })
+}
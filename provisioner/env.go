@@ -0,0 +1,195 @@
+package provisioner
+
+import (
+    "bufio"
+    "bytes"
+    "fmt"
+    "log/slog"
+    "net/http"
+    "os"
+    "strings"
+)
+
+// Parse env file content into KEY=VALUE pairs suitable for exec.Cmd.Env.
+// Values are taken literally: no shell expansion or command substitution
+// is performed, only a single pair of surrounding quotes is stripped.
+func parseEnv(data []byte) ([]string, error) {
+    var vars []string
+    scanner := bufio.NewScanner(bytes.NewReader(data))
+    lineNo := 0
+    for scanner.Scan() {
+        lineNo++
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        line = strings.TrimPrefix(line, "export ")
+
+        key, value, ok := strings.Cut(line, "=")
+        if !ok {
+            return nil, fmt.Errorf("line %d: missing '='", lineNo)
+        }
+        key = strings.TrimSpace(key)
+        if !isValidEnvKey(key) {
+            return nil, fmt.Errorf("line %d: invalid variable name %q", lineNo, key)
+        }
+        value = strings.TrimSpace(value)
+        if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+            value = value[1 : len(value)-1]
+        }
+        vars = append(vars, key+"="+value)
+    }
+    if err := scanner.Err(); err != nil {
+        return nil, err
+    }
+    return vars, nil
+}
+
+// Read and parse an env file from disk
+func parseEnvFile(filename string) ([]string, error) {
+    data, err := os.ReadFile(filename)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read env file: %v", err)
+    }
+    return parseEnv(data)
+}
+
+// Variable names follow the POSIX shell rules: letters, digits and
+// underscores, not starting with a digit
+func isValidEnvKey(key string) bool {
+    if key == "" {
+        return false
+    }
+    for i, c := range key {
+        switch {
+        case c == '_', c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z':
+        case c >= '0' && c <= '9' && i > 0:
+        default:
+            return false
+        }
+    }
+    return true
+}
+
+// Substitute $VAR and ${VAR} in data with values from env, os.Expand style.
+// A variable env doesn't set is an error rather than expanding to empty.
+func expandEnv(data []byte, env []string) ([]byte, error) {
+    values := make(map[string]string, len(env))
+    for _, kv := range env {
+        key, value, _ := strings.Cut(kv, "=")
+        values[key] = value
+    }
+
+    var missing []string
+    seen := make(map[string]bool)
+    expanded := os.Expand(string(data), func(name string) string {
+        value, ok := values[name]
+        if !ok && !seen[name] {
+            seen[name] = true
+            missing = append(missing, name)
+        }
+        return value
+    })
+    if len(missing) > 0 {
+        return nil, fmt.Errorf("unset variables: %s", strings.Join(missing, ", "))
+    }
+    return []byte(expanded), nil
+}
+
+// Env upload handler, for changing the env while the manifests stay as
+// they are. An existing env is only replaced with force=true, and every
+// version is measured into the env PCR, so verifiers see each of them in
+// the event log.
+func (s *Server) handleEnv(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    if !parseMultipart(w, r, s.cfg.MaxUploadBytes) {
+        return
+    }
+    headers := r.MultipartForm.File["env"]
+    if len(headers) != 1 {
+        writeError(w, "env must be sent exactly once", http.StatusBadRequest)
+        return
+    }
+    content, err := readFormFile(headers[0], s.cfg.MaxUploadBytes)
+    if err != nil {
+        writeReadError(w, "env", err)
+        return
+    }
+    if len(content) == 0 {
+        writeError(w, "env is empty", http.StatusBadRequest)
+        return
+    }
+    // Fail now rather than at the next start
+    if _, err := parseEnv(content); err != nil {
+        writeError(w, fmt.Sprintf("Invalid env: %v", err), http.StatusBadRequest)
+        return
+    }
+
+    // A start reads the env it measures, it mustn't change in between
+    s.startMu.Lock()
+    defer s.startMu.Unlock()
+    replaced := fileExists(s.cfg.EnvPath)
+    if replaced && r.PostFormValue("force") != "true" {
+        writeError(w, "env already exists, send force=true to replace it", http.StatusConflict)
+        return
+    }
+
+    // A replaced env that is still measured has to come back if its
+    // replacement fails, or the next start would run without it
+    var previous []byte
+    if replaced {
+        previous, err = os.ReadFile(s.cfg.EnvPath)
+        if err != nil {
+            writeStoreError(w, "write", fmt.Errorf("failed to read the current env: %v", err), nil)
+            return
+        }
+    }
+    pending := []pendingFile{{path: s.cfg.EnvPath, data: content, mode: s.cfg.EnvMode}}
+    rollBack := func() {
+        if previous == nil {
+            removeFiles(pending)
+        } else if err := s.files.atomicWriteFile(s.cfg.EnvPath, previous, s.cfg.EnvMode); err != nil {
+            slog.Error("Failed to restore the replaced env", "path", s.cfg.EnvPath, "error", err)
+        }
+    }
+    if err := s.files.writeFiles(pending); err != nil {
+        slog.Error("Failed to write env", "error", err)
+        writeStoreError(w, "write", err, nil)
+        return
+    }
+    // As with /upload, an env that failed to be measured is removed, one
+    // replacing an earlier env by restoring that
+    measured := []measuredFile{{path: s.cfg.EnvPath, pcr: envPCR}}
+    _, err = s.measurement.measureFiles(measured)
+    if err == nil {
+        if err = s.measurement.measureSummary("env", measured); err != nil {
+            err = fmt.Errorf("summary: %v", err)
+        }
+    }
+    if err != nil {
+        slog.Error("Failed to measure env, rolling it back", "replaced", replaced, "error", err)
+        rollBack()
+        writeStoreError(w, "measure", err, nil)
+        return
+    }
+    if err := s.state.markMeasured([]string{s.cfg.EnvPath}); err != nil {
+        slog.Error("Failed to persist provisioning state, rolling back env", "path", s.cfg.StatePath, "error", err)
+        rollBack()
+        writeStoreError(w, "write", fmt.Errorf("provisioning state: %v", err), []string{s.cfg.EnvPath})
+        return
+    }
+    if err := s.audit.record(measured, r.RemoteAddr); err != nil {
+        slog.Error("Failed to append to audit log", "path", s.cfg.AuditLogPath, "error", err)
+    }
+
+    code := http.StatusCreated
+    if replaced {
+        code = http.StatusOK
+    }
+    slog.Info("Env uploaded", "path", s.cfg.EnvPath, "replaced", replaced, "status", code)
+    writeJSON(w, code, uploadResponse{Files: []string{s.cfg.EnvPath}})
+}
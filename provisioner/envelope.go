@@ -0,0 +1,140 @@
+package provisioner
+
+import (
+    "crypto"
+    "crypto/ecdsa"
+    "crypto/ed25519"
+    "crypto/elliptic"
+    "crypto/rsa"
+    "crypto/sha256"
+    "crypto/sha512"
+    "crypto/x509"
+    "encoding/base64"
+    "encoding/json"
+    "encoding/pem"
+    "errors"
+    "fmt"
+    "os"
+)
+
+// Suffix of the file the verified envelope is stored in, next to its payload
+const envelopeSuffix = ".dsse"
+
+// Payload types accepted inside a DSSE envelope
+var envelopePayloadTypes = map[string]bool{
+    "application/yaml":   true,
+    "application/x-yaml": true,
+}
+
+var errInvalidSignature = errors.New("no valid signature from a trusted key")
+
+// DSSE envelope, see https://github.com/secure-systems-lab/dsse/blob/master/envelope.md
+type dsseEnvelope struct {
+    PayloadType string          `json:"payloadType"`
+    Payload     string          `json:"payload"`
+    Signatures  []dsseSignature `json:"signatures"`
+}
+
+type dsseSignature struct {
+    KeyID string `json:"keyid"`
+    Sig   string `json:"sig"`
+}
+
+// Load all PEM encoded public keys from a file
+func loadPublicKeys(filename string) ([]crypto.PublicKey, error) {
+    data, err := os.ReadFile(filename)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read keys: %v", err)
+    }
+
+    var keys []crypto.PublicKey
+    for {
+        var block *pem.Block
+        block, data = pem.Decode(data)
+        if block == nil {
+            break
+        }
+        if block.Type != "PUBLIC KEY" {
+            continue
+        }
+        key, err := x509.ParsePKIXPublicKey(block.Bytes)
+        if err != nil {
+            return nil, fmt.Errorf("failed to parse public key: %v", err)
+        }
+        keys = append(keys, key)
+    }
+    if len(keys) == 0 {
+        return nil, fmt.Errorf("no public keys found in %s", filename)
+    }
+    return keys, nil
+}
+
+// Verify a DSSE envelope against the trusted keys and return its payload
+func openEnvelope(data []byte, keys []crypto.PublicKey) ([]byte, error) {
+    var env dsseEnvelope
+    if err := json.Unmarshal(data, &env); err != nil {
+        return nil, fmt.Errorf("invalid envelope: %v", err)
+    }
+    if !envelopePayloadTypes[env.PayloadType] {
+        return nil, fmt.Errorf("unsupported payload type %q", env.PayloadType)
+    }
+    payload, err := decodeBase64(env.Payload)
+    if err != nil {
+        return nil, fmt.Errorf("invalid envelope payload: %v", err)
+    }
+
+    message := dssePAE(env.PayloadType, payload)
+    for _, s := range env.Signatures {
+        sig, err := decodeBase64(s.Sig)
+        if err != nil {
+            continue
+        }
+        for _, key := range keys {
+            if verifySignature(key, message, sig) {
+                return payload, nil
+            }
+        }
+    }
+    return nil, errInvalidSignature
+}
+
+// DSSE pre-authentication encoding, the byte string that is actually signed
+func dssePAE(payloadType string, payload []byte) []byte {
+    return []byte(fmt.Sprintf("DSSEv1 %d %s %d %s", len(payloadType), payloadType, len(payload), payload))
+}
+
+// DSSE allows both the standard and the URL-safe base64 alphabet
+func decodeBase64(s string) ([]byte, error) {
+    if b, err := base64.StdEncoding.DecodeString(s); err == nil {
+        return b, nil
+    }
+    return base64.URLEncoding.DecodeString(s)
+}
+
+func verifySignature(key crypto.PublicKey, message, sig []byte) bool {
+    switch k := key.(type) {
+    case ed25519.PublicKey:
+        return ed25519.Verify(k, message, sig)
+    case *ecdsa.PublicKey:
+        var digest []byte
+        switch k.Curve {
+        case elliptic.P384():
+            h := sha512.Sum384(message)
+            digest = h[:]
+        case elliptic.P521():
+            h := sha512.Sum512(message)
+            digest = h[:]
+        default:
+            h := sha256.Sum256(message)
+            digest = h[:]
+        }
+        return ecdsa.VerifyASN1(k, digest, sig)
+    case *rsa.PublicKey:
+        digest := sha256.Sum256(message)
+        if rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) == nil {
+            return true
+        }
+        return rsa.VerifyPSS(k, crypto.SHA256, digest[:], sig, nil) == nil
+    }
+    return false
+}
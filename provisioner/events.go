@@ -0,0 +1,87 @@
+package provisioner
+
+import (
+    "bufio"
+    "context"
+    "fmt"
+    "log/slog"
+    "net/http"
+    "os/exec"
+)
+
+// Whether podman knows a pod of this name
+func podExists(podman, name string) bool {
+    return exec.Command(podman, "pod", "exists", name).Run() == nil
+}
+
+// Events handler, relaying `podman events` for the provisioned pods to the
+// client as server-sent events until it disconnects
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    if s.podmanPath == "" {
+        writeError(w, fmt.Sprintf("Events are not supported with the %s runtime", s.cfg.Runtime), http.StatusNotImplemented)
+        return
+    }
+
+    names, err := podNames(s.cfg.ManifestDir)
+    if err != nil {
+        writeError(w, fmt.Sprintf("Failed to read pod names: %v", err), http.StatusInternalServerError)
+        return
+    }
+    args := []string{"events", "--format", "json"}
+    for _, name := range names {
+        if podExists(s.podmanPath, name) {
+            args = append(args, "--filter", "pod="+name)
+        }
+    }
+    if len(args) == 3 {
+        writeError(w, "No pod exists yet", http.StatusConflict)
+        return
+    }
+
+    // The stream lasts as long as the client wants it
+    disableWriteTimeout(w)
+    
+    // The child is killed once the client goes away, or once relaying stops
+    ctx, cancel := context.WithCancel(r.Context())
+    cmd := exec.CommandContext(ctx, s.podmanPath, args...)
+    stdout, err := cmd.StdoutPipe()
+    if err != nil {
+        cancel()
+        writeError(w, fmt.Sprintf("Failed to run podman events: %v", err), http.StatusInternalServerError)
+        return
+    }
+    if err := cmd.Start(); err != nil {
+        cancel()
+        writeError(w, fmt.Sprintf("Failed to run podman events: %v", err), http.StatusInternalServerError)
+        return
+    }
+    defer cmd.Wait()
+    defer cancel()
+
+    w.Header().Set("Content-Type", "text/event-stream")
+    w.Header().Set("Cache-Control", "no-cache")
+    w.WriteHeader(http.StatusOK)
+    rc := http.NewResponseController(w)
+    if err := rc.Flush(); err != nil {
+        return
+    }
+
+    // podman prints one JSON object per line, each becomes one event
+    scanner := bufio.NewScanner(stdout)
+    for scanner.Scan() {
+        if _, err := fmt.Fprintf(w, "data: %s\n\n", scanner.Bytes()); err != nil {
+            return
+        }
+        if err := rc.Flush(); err != nil {
+            return
+        }
+    }
+    if err := scanner.Err(); err != nil && ctx.Err() == nil {
+        slog.Warn("Failed to read podman events", "error", err)
+    }
+}
@@ -0,0 +1,149 @@
+package provisioner
+
+import (
+    "errors"
+    "fmt"
+    "io/fs"
+    "log/slog"
+    "net/http"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+)
+
+// Form fields of a /measure request
+const (
+    measureFileField = "file"
+    measurePCRField  = "pcr"
+)
+
+// Body of a successful /measure
+type measureResponse struct {
+    Path string `json:"path"`
+    PCR  int    `json:"pcr"`
+}
+
+// PCRs extra files and secrets may be measured into. 0-7 belong to the
+// firmware and the pod and env PCRs only ever hold what /upload measured.
+func validateExtraPCR(pcr int) error {
+    if pcr < 8 || pcr > 23 || pcr == podPCR || pcr == envPCR {
+        return fmt.Errorf("PCR %d is not available (want 8-23 except %d and %d)", pcr, podPCR, envPCR)
+    }
+    return nil
+}
+
+// Path an extra file is stored at. Only plain names are accepted, so
+// nothing is ever written outside dir, and none a temp file could have,
+// which the startup cleanup would remove.
+func extraFilePath(dir, name string) (string, error) {
+    if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") || tempNamePattern.MatchString(name) {
+        return "", fmt.Errorf("invalid file name %q", name)
+    }
+    return filepath.Join(dir, name), nil
+}
+
+// Whether name is that of one of the server's own files. The measure
+// directory is never theirs, but an extra file of the same name would
+// still be easily mistaken for the real one.
+func (s *Server) isReservedFileName(name string) bool {
+    name = strings.TrimSuffix(name, envelopeSuffix)
+    if matched, _ := filepath.Match(filepath.Base(podManifestGlob("")), name); matched {
+        return true
+    }
+    for _, path := range []string{podManifestPath("", 0), s.cfg.EnvPath, s.cfg.StatePath, s.cfg.EventLogPath, s.cfg.AuditLogPath, s.cfg.SecretsPath} {
+        if path != "" && name == filepath.Base(path) {
+            return true
+        }
+    }
+    return false
+}
+
+// Extra file handler, for supplementary files like a policy bundle or a
+// launch script that have to be attested along with the pod
+func (s *Server) handleMeasure(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    if s.cfg.MeasureDir == "" {
+        writeError(w, "No directory for extra files configured", http.StatusNotFound)
+        return
+    }
+
+    if !parseMultipart(w, r, s.cfg.MaxUploadBytes) {
+        return
+    }
+
+    headers := r.MultipartForm.File[measureFileField]
+    if len(headers) != 1 {
+        writeError(w, fmt.Sprintf("%s must be sent exactly once", measureFileField), http.StatusBadRequest)
+        return
+    }
+    pcr, err := strconv.Atoi(r.PostFormValue(measurePCRField))
+    if err != nil {
+        writeError(w, fmt.Sprintf("Invalid %s index %q", measurePCRField, r.PostFormValue(measurePCRField)), http.StatusBadRequest)
+        return
+    }
+    if err := validateExtraPCR(pcr); err != nil {
+        writeError(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    if s.cfg.SecretsPath != "" && pcr == s.cfg.SecretsPCR {
+        writeError(w, fmt.Sprintf("PCR %d is reserved for secrets", pcr), http.StatusBadRequest)
+        return
+    }
+    if pcr == s.measurement.summaryPCR {
+        writeError(w, fmt.Sprintf("PCR %d is reserved for the provisioning summary", pcr), http.StatusBadRequest)
+        return
+    }
+    path, err := extraFilePath(s.cfg.MeasureDir, headers[0].Filename)
+    if err != nil {
+        writeError(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    if s.isReservedFileName(headers[0].Filename) {
+        writeError(w, fmt.Sprintf("%s is reserved for the server's own files", headers[0].Filename), http.StatusBadRequest)
+        return
+    }
+
+    // Like pod.yaml and env, an extra file is only ever measured once
+    if _, err := os.Lstat(path); !errors.Is(err, fs.ErrNotExist) {
+        writeError(w, fmt.Sprintf("%s already exists", headers[0].Filename), http.StatusConflict)
+        return
+    }
+
+    content, err := readFormFile(headers[0], s.cfg.MaxUploadBytes)
+    if err != nil {
+        writeReadError(w, headers[0].Filename, err)
+        return
+    }
+
+    // Check again under the lock uploads write under, so of two requests
+    // for the same name only one writes and measures it
+    s.startMu.Lock()
+    defer s.startMu.Unlock()
+    if _, err := os.Lstat(path); !errors.Is(err, fs.ErrNotExist) {
+        writeError(w, fmt.Sprintf("%s already exists", headers[0].Filename), http.StatusConflict)
+        return
+    }
+    if err := s.files.atomicWriteFile(path, content, 0600); err != nil {
+        writeStoreError(w, "write", fmt.Errorf("%s: %v", headers[0].Filename, err), nil)
+        return
+    }
+
+    // Like an upload, a file that failed to be measured is removed again
+    measured := []measuredFile{{path: path, pcr: pcr}}
+    if _, err := s.measurement.measureFiles(measured); err != nil {
+        slog.Error("Failed to measure extra file, removing it", "path", path, "error", err)
+        removeFiles([]pendingFile{{path: path}})
+        writeStoreError(w, "measure", err, nil)
+        return
+    }
+    if err := s.audit.record(measured, r.RemoteAddr); err != nil {
+        slog.Error("Failed to append to audit log", "path", s.cfg.AuditLogPath, "error", err)
+    }
+
+    slog.Info("Extra file measured", "path", path, "pcr", pcr, "status", http.StatusCreated)
+    writeJSON(w, http.StatusCreated, measureResponse{Path: path, PCR: pcr})
+}
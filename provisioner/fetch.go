@@ -0,0 +1,63 @@
+package provisioner
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "net/url"
+    "time"
+)
+
+// Form field naming a URL to fetch pod.yaml from instead of uploading it
+const podURLField = "pod_url"
+
+var errInvalidManifestURL = errors.New("manifest URL must be an absolute https URL")
+
+// Client for manifest fetches, refusing to be redirected off HTTPS
+var fetchClient = &http.Client{
+    CheckRedirect: func(req *http.Request, via []*http.Request) error {
+        if req.URL.Scheme != "https" {
+            return fmt.Errorf("refusing redirect to %s", req.URL.Redacted())
+        }
+        if len(via) >= 10 {
+            return errors.New("too many redirects")
+        }
+        return nil
+    },
+}
+
+// Fetch a manifest over HTTPS, bounded by timeout and by limit bytes, the
+// same size limit as an uploaded file
+func fetchManifest(ctx context.Context, rawURL string, timeout time.Duration, limit int64) ([]byte, error) {
+    u, err := url.Parse(rawURL)
+    if err != nil || u.Scheme != "https" || u.Host == "" {
+        return nil, errInvalidManifestURL
+    }
+
+    ctx, cancel := context.WithTimeout(ctx, timeout)
+    defer cancel()
+
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+    if err != nil {
+        return nil, errInvalidManifestURL
+    }
+    resp, err := fetchClient.Do(req)
+    if err != nil {
+        return nil, fmt.Errorf("failed to fetch manifest: %v", err)
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("failed to fetch manifest: unexpected status %s", resp.Status)
+    }
+    data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+    if err != nil {
+        return nil, fmt.Errorf("failed to fetch manifest: %v", err)
+    }
+    if int64(len(data)) > limit {
+        return nil, fmt.Errorf("fetched manifest exceeds the maximum size of %d bytes", limit)
+    }
+    return data, nil
+}
@@ -0,0 +1,273 @@
+package provisioner
+
+import (
+    "compress/gzip"
+    "errors"
+    "fmt"
+    "io"
+    "log/slog"
+    "mime/multipart"
+    "net/http"
+    "os"
+    "path/filepath"
+    "regexp"
+    "strings"
+    "syscall"
+    "time"
+)
+
+// Suffix of the temp files atomicWriteFile renames into place
+const tempSuffix = ".tmp"
+
+// Names of those temp files: the target's, the suffix and the random
+// digits os.CreateTemp appends. Anything else is left alone by the
+// cleanup, like a policy.tmpl that was measured.
+var tempNamePattern = regexp.MustCompile(`\.tmp[0-9]+$`)
+
+// Writes files atomically by renaming temp files into place, with the
+// temp dir and rename retry policy of one Server
+type fileWriter struct {
+    // Directory the temp files are created in, by target directory. Only
+    // targets on the same filesystem are listed, anything else gets its
+    // temp files next to it so the rename can't cross devices.
+    tempDirs map[string]string
+    // How often a rename failing with one of transientErrnos is retried
+    renameRetries   int
+    transientErrnos map[syscall.Errno]bool
+    // os.Rename, replaced in tests to inject failures
+    rename func(oldpath, newpath string) error
+}
+
+// File writer keeping temp files next to their targets
+func newFileWriter(renameRetries int, transientErrnos map[syscall.Errno]bool) *fileWriter {
+    return &fileWriter{renameRetries: renameRetries, transientErrnos: transientErrnos, rename: os.Rename}
+}
+
+// Atomic file write using rename, the file ending up with the given mode
+func (fw *fileWriter) atomicWriteFile(filename string, data []byte, mode os.FileMode) error {
+    // Create temp file with a random suffix, so concurrent writers and
+    // leftovers of an interrupted write can't collide with it
+    f, err := os.CreateTemp(fw.tempDirFor(filename), filepath.Base(filename)+tempSuffix+"*")
+    if err != nil {
+        return fmt.Errorf("failed to create temp file: %v", err)
+    }
+    defer f.Close()
+    tempFile := f.Name()
+    
+    // Set the mode explicitly, independent of the umask
+    if err := f.Chmod(mode); err != nil {
+        os.Remove(tempFile)
+        return fmt.Errorf("failed to set temp file mode: %v", err)
+    }
+    
+    // Write data
+    if _, err := f.Write(data); err != nil {
+        os.Remove(tempFile)
+        return fmt.Errorf("failed to write temp file: %v", err)
+    }
+    
+    // Sync to ensure data is written to disk
+    if err := f.Sync(); err != nil {
+        os.Remove(tempFile)
+        return fmt.Errorf("failed to sync temp file: %v", err)
+    }
+    
+    // Atomic rename, retried on transient errors
+    if err := fw.renameWithRetry(tempFile, filename); err != nil {
+        os.Remove(tempFile)
+        return fmt.Errorf("failed to rename temp file: %v", err)
+    }
+    
+    return nil
+}
+
+// Where the temp file for filename goes
+func (fw *fileWriter) tempDirFor(filename string) string {
+    dir := filepath.Dir(filename)
+    if tempDir, ok := fw.tempDirs[dir]; ok {
+        return tempDir
+    }
+    return dir
+}
+
+// Use tempDir for the temp files of every target directory on the same
+// filesystem, comparing their devices. Fails if tempDir shares a
+// filesystem with none of them, as it would never be used.
+func (fw *fileWriter) setTempDir(tempDir string, targets []string) error {
+    info, err := os.Stat(tempDir)
+    if err != nil {
+        return err
+    }
+    if !info.IsDir() {
+        return fmt.Errorf("%s is not a directory", tempDir)
+    }
+    dev := info.Sys().(*syscall.Stat_t).Dev
+
+    dirs := make(map[string]string)
+    for _, target := range targets {
+        targetInfo, err := os.Stat(target)
+        if err != nil {
+            return err
+        }
+        if targetInfo.Sys().(*syscall.Stat_t).Dev != dev {
+            slog.Warn("Temp dir is on another filesystem, writing temp files next to the target", "temp_dir", tempDir, "target_dir", target)
+            continue
+        }
+        dirs[target] = tempDir
+    }
+    if len(dirs) == 0 {
+        return fmt.Errorf("%s is on another filesystem than every target directory", tempDir)
+    }
+    fw.tempDirs = dirs
+    return nil
+}
+
+// Errno names accepted in Config.RenameRetryErrnos
+var errnoNames = map[string]syscall.Errno{
+    "EAGAIN":    syscall.EAGAIN,
+    "EBUSY":     syscall.EBUSY,
+    "EINTR":     syscall.EINTR,
+    "EIO":       syscall.EIO,
+    "ESTALE":    syscall.ESTALE,
+    "ETIMEDOUT": syscall.ETIMEDOUT,
+}
+
+// Parse a list of errno names
+func parseErrnos(names []string) (map[syscall.Errno]bool, error) {
+    errnos := make(map[syscall.Errno]bool)
+    for _, name := range names {
+        errno, ok := errnoNames[name]
+        if !ok {
+            return nil, fmt.Errorf("unsupported errno %q", name)
+        }
+        errnos[errno] = true
+    }
+    return errnos, nil
+}
+
+// Rename, retrying with a small exponential backoff while it fails with one
+// of the configured transient errno values. Any other error, such as ENOSPC
+// or EROFS, is returned immediately.
+func (fw *fileWriter) renameWithRetry(oldpath, newpath string) error {
+    delay := 10 * time.Millisecond
+    for attempt := 0; ; attempt++ {
+        err := fw.rename(oldpath, newpath)
+        if err == nil {
+            return nil
+        }
+        var errno syscall.Errno
+        if attempt >= fw.renameRetries || !errors.As(err, &errno) || !fw.transientErrnos[errno] {
+            return err
+        }
+        slog.Warn("Transient rename failure, retrying", "path", newpath, "attempt", attempt+1, "error", err)
+        time.Sleep(delay)
+        delay *= 2
+    }
+}
+
+// A file to be written by writeFiles
+type pendingFile struct {
+    path string
+    data []byte
+    mode os.FileMode
+}
+
+// Atomically write a set of files, all or nothing: if one write fails, the
+// files written before it are removed again
+func (fw *fileWriter) writeFiles(files []pendingFile) error {
+    for i, f := range files {
+        if err := fw.atomicWriteFile(f.path, f.data, f.mode); err != nil {
+            removeFiles(files[:i])
+            return fmt.Errorf("%s: %v", filepath.Base(f.path), err)
+        }
+    }
+    return nil
+}
+
+// Roll back files written by writeFiles
+func removeFiles(files []pendingFile) {
+    for _, f := range files {
+        if err := os.Remove(f.path); err != nil {
+            slog.Error("Failed to roll back written file", "path", f.path, "error", err)
+        }
+    }
+}
+
+// Remove temp files left behind by an atomicWriteFile that never got to
+// the rename, e.g. because the process was killed half way
+func (fw *fileWriter) cleanupTempFiles(patterns ...string) {
+    for _, pattern := range patterns {
+        pattern = filepath.Join(fw.tempDirFor(pattern), filepath.Base(pattern))
+        matches, err := filepath.Glob(pattern + tempSuffix + "*")
+        if err != nil {
+            slog.Warn("Invalid temp file pattern", "pattern", pattern, "error", err)
+            continue
+        }
+        for _, match := range matches {
+            if !tempNamePattern.MatchString(match) {
+                continue
+            }
+            if err := os.Remove(match); err != nil {
+                slog.Warn("Failed to remove stale temp file", "path", match, "error", err)
+                continue
+            }
+            slog.Info("Removed stale temp file", "path", match)
+        }
+    }
+}
+
+// Check if a file exists
+func fileExists(filename string) bool {
+    _, err := os.Stat(filename)
+    return err == nil
+}
+
+var (
+    errInvalidGzip          = errors.New("invalid gzip data")
+    errDecompressedTooLarge = errors.New("decompressed data exceeds the maximum upload size")
+)
+
+// Read the full content of an uploaded multipart file. Parts sent with
+// Content-Encoding: gzip or a .gz filename are decompressed, so what gets
+// written and measured doesn't depend on the transport encoding. The
+// decompressed size is bounded by limit.
+func readFormFile(header *multipart.FileHeader, limit int64) ([]byte, error) {
+    f, err := header.Open()
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+    
+    if header.Header.Get("Content-Encoding") != "gzip" && !strings.HasSuffix(header.Filename, ".gz") {
+        return io.ReadAll(f)
+    }
+    
+    zr, err := gzip.NewReader(f)
+    if err != nil {
+        return nil, fmt.Errorf("%w: %v", errInvalidGzip, err)
+    }
+    defer zr.Close()
+    
+    // Bound the decompressed size as well, a small upload can inflate a lot
+    data, err := io.ReadAll(io.LimitReader(zr, limit+1))
+    if err != nil {
+        return nil, fmt.Errorf("%w: %v", errInvalidGzip, err)
+    }
+    if int64(len(data)) > limit {
+        return nil, errDecompressedTooLarge
+    }
+    return data, nil
+}
+
+// Report a failure to read an uploaded file with a matching status code
+func writeReadError(w http.ResponseWriter, name string, err error) {
+    switch {
+    case errors.Is(err, errInvalidGzip):
+        writeError(w, fmt.Sprintf("Failed to read %s: %v", name, err), http.StatusBadRequest)
+    case errors.Is(err, errDecompressedTooLarge):
+        writeError(w, fmt.Sprintf("Failed to read %s: %v", name, err), http.StatusRequestEntityTooLarge)
+    default:
+        writeError(w, fmt.Sprintf("Failed to read %s", name), http.StatusInternalServerError)
+    }
+}
+
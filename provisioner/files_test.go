@@ -0,0 +1,93 @@
+package provisioner
+
+import (
+    "os"
+    "path/filepath"
+    "syscall"
+    "testing"
+
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/require"
+)
+
+// A rename failing with errno, as os.Rename reports it
+func renameError(oldpath, newpath string, errno syscall.Errno) error {
+    return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: errno}
+}
+
+// Temp files atomicWriteFile left behind for path
+func leftoverTempFiles(t *testing.T, path string) []string {
+    matches, err := filepath.Glob(path + tempSuffix + "*")
+    require.NoError(t, err)
+    return matches
+}
+
+func TestAtomicWriteFileRetriesTransientRenameFailure(t *testing.T) {
+    fw := newFileWriter(3, map[syscall.Errno]bool{syscall.EBUSY: true})
+    calls := 0
+    fw.rename = func(oldpath, newpath string) error {
+        calls++
+        if calls == 1 {
+            return renameError(oldpath, newpath, syscall.EBUSY)
+        }
+        return os.Rename(oldpath, newpath)
+    }
+
+    path := filepath.Join(t.TempDir(), "pod.yaml")
+    require.NoError(t, fw.atomicWriteFile(path, []byte("kind: Pod\n"), 0600))
+    assert.Equal(t, 2, calls)
+
+    data, err := os.ReadFile(path)
+    require.NoError(t, err)
+    assert.Equal(t, "kind: Pod\n", string(data))
+    assert.Empty(t, leftoverTempFiles(t, path))
+}
+
+func TestAtomicWriteFileFailsOnPermanentRenameFailure(t *testing.T) {
+    fw := newFileWriter(3, map[syscall.Errno]bool{syscall.EBUSY: true})
+    calls := 0
+    fw.rename = func(oldpath, newpath string) error {
+        calls++
+        return renameError(oldpath, newpath, syscall.EROFS)
+    }
+
+    path := filepath.Join(t.TempDir(), "pod.yaml")
+    err := fw.atomicWriteFile(path, []byte("kind: Pod\n"), 0600)
+    require.Error(t, err)
+    assert.ErrorContains(t, err, syscall.EROFS.Error())
+    assert.Equal(t, 1, calls)
+    assert.NoFileExists(t, path)
+    assert.Empty(t, leftoverTempFiles(t, path))
+}
+
+func TestAtomicWriteFileGivesUpAfterRenameRetries(t *testing.T) {
+    fw := newFileWriter(2, map[syscall.Errno]bool{syscall.ESTALE: true})
+    calls := 0
+    fw.rename = func(oldpath, newpath string) error {
+        calls++
+        return renameError(oldpath, newpath, syscall.ESTALE)
+    }
+
+    path := filepath.Join(t.TempDir(), "pod.yaml")
+    require.Error(t, fw.atomicWriteFile(path, []byte("kind: Pod\n"), 0600))
+    assert.Equal(t, 3, calls)
+    assert.NoFileExists(t, path)
+    assert.Empty(t, leftoverTempFiles(t, path))
+}
+
+func TestCleanupTempFilesOnlyRemovesTempFiles(t *testing.T) {
+    dir := t.TempDir()
+    kept := []string{"policy.tmpl", "policy.tmp", "policy.tmp12a", "launch.sh"}
+    removed := []string{"policy.tmpl.tmp123", "launch.sh.tmp4294967295"}
+    for _, name := range append(kept, removed...) {
+        require.NoError(t, os.WriteFile(filepath.Join(dir, name), nil, 0600))
+    }
+
+    newFileWriter(0, nil).cleanupTempFiles(filepath.Join(dir, "*"))
+    for _, name := range kept {
+        assert.FileExists(t, filepath.Join(dir, name))
+    }
+    for _, name := range removed {
+        assert.NoFileExists(t, filepath.Join(dir, name))
+    }
+}
@@ -0,0 +1,790 @@
+package provisioner
+
+import (
+    "errors"
+    "fmt"
+    "log/slog"
+    "mime/multipart"
+    "net/http"
+    "path/filepath"
+    "strings"
+    "time"
+)
+
+// Parse the multipart form of r, capping the request body at limit bytes.
+// A body that isn't multipart parses as an empty form, leaving the handler
+// to report the parts it misses. Writes the error response and returns
+// false if the form can't be parsed.
+func parseMultipart(w http.ResponseWriter, r *http.Request, limit int64) bool {
+    r.Body = http.MaxBytesReader(w, r.Body, limit)
+    err := r.ParseMultipartForm(limit)
+    var maxBytesErr *http.MaxBytesError
+    if errors.As(err, &maxBytesErr) {
+        writeError(w, fmt.Sprintf("Upload exceeds the maximum size of %d bytes", maxBytesErr.Limit), http.StatusRequestEntityTooLarge)
+        return false
+    } else if errors.Is(err, http.ErrNotMultipart) {
+        r.MultipartForm = &multipart.Form{}
+    } else if err != nil {
+        writeError(w, "Failed to parse form", http.StatusBadRequest)
+        return false
+    }
+    return true
+}
+
+// File upload handler
+func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    
+    if !parseMultipart(w, r, s.cfg.MaxUploadBytes) {
+        return
+    }
+    
+    // A pod_url without a pod.yaml part means pod.yaml is fetched instead
+    var podURL string
+    if urls := r.MultipartForm.Value[podURLField]; len(urls) > 0 && len(r.MultipartForm.File[podManifestField]) == 0 {
+        podURL = urls[0]
+    }
+    
+    // Handle pod.yaml and any additional pod.yaml.N manifests
+    var podHeaders []*multipart.FileHeader
+    if podURL == "" {
+        var err error
+        podHeaders, err = formManifests(r.MultipartForm)
+        if err != nil {
+            writeError(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+    } else {
+        for field := range r.MultipartForm.File {
+            if strings.HasPrefix(field, podManifestField+".") {
+                writeError(w, fmt.Sprintf("%s can't be combined with %s", podURLField, field), http.StatusBadRequest)
+                return
+            }
+        }
+    }
+    
+    // Check every file the upload would write up front, so the client
+    // learns about all conflicts at once, before anything is processed
+    manifestCount := len(podHeaders)
+    if podURL != "" {
+        manifestCount = 1
+    }
+    if !s.checkUploadConflicts(w, r.MultipartForm, manifestCount) {
+        return
+    }
+    
+    // Read manifest contents, keeping the canonical order. podSources
+    // names each manifest for error messages.
+    var podContents [][]byte
+    var podSources []string
+    if podURL != "" {
+        podContent, err := fetchManifest(r.Context(), podURL, s.cfg.FetchTimeout, s.cfg.MaxUploadBytes)
+        if errors.Is(err, errInvalidManifestURL) {
+            writeError(w, err.Error(), http.StatusBadRequest)
+            return
+        } else if err != nil {
+            writeError(w, err.Error(), http.StatusBadGateway)
+            return
+        }
+        podContents = [][]byte{podContent}
+        podSources = []string{podURL}
+    }
+    for _, header := range podHeaders {
+        podContent, err := readFormFile(header, s.cfg.MaxUploadBytes)
+        if err != nil {
+            writeReadError(w, header.Filename, err)
+            return
+        }
+        podContents = append(podContents, podContent)
+        podSources = append(podSources, header.Filename)
+    }
+    s.finishUpload(w, r, podContents, podSources)
+}
+
+// Check the files an upload of manifestCount manifests and the env and
+// secrets parts of form would write, answering with a 409 listing every
+// one that already exists. Returns whether the upload may go ahead.
+func (s *Server) checkUploadConflicts(w http.ResponseWriter, form *multipart.Form, manifestCount int) bool {
+    var conflicts []string
+    for i := 0; i < manifestCount; i++ {
+        if path := podManifestPath(s.cfg.ManifestDir, i); fileExists(path) {
+            conflicts = append(conflicts, filepath.Base(path))
+        }
+    }
+    if len(form.File["env"]) > 0 && fileExists(s.cfg.EnvPath) {
+        conflicts = append(conflicts, filepath.Base(s.cfg.EnvPath))
+    }
+    secretsHeaders := form.File[secretsField]
+    if len(secretsHeaders) > 0 && s.cfg.SecretsPath == "" {
+        writeError(w, "secrets are not enabled on this server", http.StatusBadRequest)
+        return false
+    }
+    if len(secretsHeaders) > 0 && fileExists(s.cfg.SecretsPath) {
+        conflicts = append(conflicts, secretsField)
+    }
+    if len(conflicts) > 0 {
+        writeJSON(w, http.StatusConflict, conflictResponse{
+            Error:     fmt.Sprintf("Files already exist: %s", strings.Join(conflicts, ", ")),
+            Code:      http.StatusConflict,
+            Conflicts: conflicts,
+        })
+        return false
+    }
+    return true
+}
+
+// Check manifests against the document limit, the allowed kinds and the
+// allowed registries, answering with an error for the first that fails.
+// Returns whether they may be written or handed to the runtime.
+func (s *Server) checkManifests(w http.ResponseWriter, podContents [][]byte, podSources []string) bool {
+    // Guard against huge or unexpected manifests
+    documents := 0
+    for i, podContent := range podContents {
+        var err error
+        documents, err = checkManifestDocuments(podContent, documents, s.cfg.MaxDocuments, s.allowedKinds)
+        if err != nil {
+            writeError(w, fmt.Sprintf("%s: %v", podSources[i], err), http.StatusBadRequest)
+            return false
+        }
+    }
+    
+    // Reject images from registries that aren't allowlisted, listing
+    // every offending image
+    if len(s.cfg.AllowedRegistries) > 0 {
+        var disallowed []string
+        for i, podContent := range podContents {
+            images, err := manifestImages(podContent)
+            if err != nil {
+                writeError(w, fmt.Sprintf("%s: %v", podSources[i], err), http.StatusBadRequest)
+                return false
+            }
+            disallowed = append(disallowed, disallowedImages(images, s.cfg.AllowedRegistries)...)
+        }
+        if len(disallowed) > 0 {
+            writeError(w, fmt.Sprintf("Images from registries that are not allowed: %s", strings.Join(disallowed, ", ")), http.StatusForbidden)
+            return false
+        }
+    }
+    return true
+}
+
+// Process the manifests of an upload along with the env, secrets and
+// options of its form: unwrap, expand and rewrite them as asked, check
+// them, then write and measure everything. podSources names each manifest
+// for error messages. Returns whether the upload was stored.
+func (s *Server) finishUpload(w http.ResponseWriter, r *http.Request, podContents [][]byte, podSources []string) bool {
+    var err error
+    
+    // An empty manifest would be measured as the hash of nothing and only
+    // fail at /start
+    for i, podContent := range podContents {
+        if len(podContent) == 0 {
+            writeError(w, fmt.Sprintf("%s: manifest is empty", podSources[i]), http.StatusBadRequest)
+            return false
+        }
+    }
+    
+    // Unwrap signed envelopes; the payload is what gets written and
+    // measured, the verified envelope is stored next to it
+    var envelopes [][]byte
+    if len(s.envelopeKeys) > 0 {
+        envelopes = podContents
+        podContents = make([][]byte, len(envelopes))
+        for i, envelope := range envelopes {
+            payload, err := openEnvelope(envelope, s.envelopeKeys)
+            if errors.Is(err, errInvalidSignature) {
+                writeError(w, fmt.Sprintf("%s: %v", podSources[i], err), http.StatusForbidden)
+                return false
+            } else if err != nil {
+                writeError(w, fmt.Sprintf("%s: %v", podSources[i], err), http.StatusBadRequest)
+                return false
+            }
+            // A validly signed envelope may still carry nothing
+            if len(payload) == 0 {
+                writeError(w, fmt.Sprintf("%s: manifest is empty", podSources[i]), http.StatusBadRequest)
+                return false
+            }
+            podContents[i] = payload
+        }
+    }
+    
+    // Handle optional env file
+    var envContent []byte
+    if envHeaders := r.MultipartForm.File["env"]; len(envHeaders) > 0 {
+        envContent, err = readFormFile(envHeaders[0], s.cfg.MaxUploadBytes)
+        if err != nil {
+            writeReadError(w, "env", err)
+            return false
+        }
+        if len(envContent) == 0 {
+            writeError(w, "env is empty", http.StatusBadRequest)
+            return false
+        }
+    }
+    
+    // Handle optional secrets, checked to be a valid env file up front as
+    // they can't be inspected once written
+    var secretsContent []byte
+    if secretsHeaders := r.MultipartForm.File[secretsField]; len(secretsHeaders) > 0 {
+        secretsContent, err = readFormFile(secretsHeaders[0], s.cfg.MaxUploadBytes)
+        if err != nil {
+            writeReadError(w, secretsField, err)
+            return false
+        }
+        if _, err := parseEnv(secretsContent); err != nil {
+            writeError(w, fmt.Sprintf("Invalid secrets: %v", err), http.StatusBadRequest)
+            return false
+        }
+    }
+    
+    // Optionally fill ${VAR} placeholders from the uploaded env. The
+    // expanded manifest is what gets written and measured.
+    if r.PostFormValue("expand") == "true" {
+        if envelopes != nil {
+            writeError(w, "expand can't be used with signed envelopes", http.StatusBadRequest)
+            return false
+        }
+        envVars, err := parseEnv(envContent)
+        if err != nil {
+            writeError(w, fmt.Sprintf("Invalid env: %v", err), http.StatusBadRequest)
+            return false
+        }
+        for i, podContent := range podContents {
+            expanded, err := expandEnv(podContent, envVars)
+            if err != nil {
+                writeError(w, fmt.Sprintf("%s: %v", podSources[i], err), http.StatusBadRequest)
+                return false
+            }
+            podContents[i] = expanded
+        }
+    }
+    
+    // Optionally rename the pod or move it to another namespace. The
+    // rewritten manifest is what gets written and measured.
+    podName, namespace := r.PostFormValue("pod_name"), r.PostFormValue("namespace")
+    if podName != "" || namespace != "" {
+        if envelopes != nil {
+            writeError(w, "pod_name and namespace can't be used with signed envelopes", http.StatusBadRequest)
+            return false
+        }
+        for _, value := range []string{podName, namespace} {
+            if value == "" {
+                continue
+            }
+            if err := validateDNS1123Label(value); err != nil {
+                writeError(w, err.Error(), http.StatusBadRequest)
+                return false
+            }
+        }
+        
+        renamed := 0
+        for i, podContent := range podContents {
+            rewritten, n, err := rewriteManifestMetadata(podContent, podName, namespace)
+            if err != nil {
+                writeError(w, fmt.Sprintf("%s: %v", podSources[i], err), http.StatusBadRequest)
+                return false
+            }
+            podContents[i] = rewritten
+            renamed += n
+        }
+        if podName != "" && renamed != 1 {
+            writeError(w, fmt.Sprintf("pod_name needs exactly one Pod or Deployment in the manifests, found %d", renamed), http.StatusBadRequest)
+            return false
+        }
+    }
+    
+    if !s.checkManifests(w, podContents, podSources) {
+        return false
+    }
+    
+    // From here on a start has to wait: it mustn't run files that aren't
+    // measured yet, or that are about to be removed again because
+    // measuring them failed
+    s.startMu.Lock()
+    defer s.startMu.Unlock()
+    
+    // Check for conflicts again under the lock: the check up front was
+    // only to fail early, a concurrent upload may have written since
+    if !s.checkUploadConflicts(w, r.MultipartForm, len(podContents)) {
+        return false
+    }
+    
+    // Write every file before measuring any of them, so a failed write
+    // never leaves a PCR extended for a half-committed upload
+    podPaths := make([]string, len(podContents))
+    var pending []pendingFile
+    var measured []measuredFile
+    for i, podContent := range podContents {
+        path := podManifestPath(s.cfg.ManifestDir, i)
+        podPaths[i] = path
+        pending = append(pending, pendingFile{path: path, data: podContent, mode: s.cfg.PodMode})
+        if envelopes != nil {
+            pending = append(pending, pendingFile{path: path + envelopeSuffix, data: envelopes[i], mode: s.cfg.PodMode})
+        }
+        measured = append(measured, measuredFile{path: path, pcr: podPCR})
+    }
+    if len(envContent) > 0 {
+        pending = append(pending, pendingFile{path: s.cfg.EnvPath, data: envContent, mode: s.cfg.EnvMode})
+        measured = append(measured, measuredFile{path: s.cfg.EnvPath, pcr: envPCR})
+    }
+    if len(secretsContent) > 0 {
+        pending = append(pending, pendingFile{path: s.cfg.SecretsPath, data: secretsContent, mode: 0600})
+        measured = append(measured, measuredFile{path: s.cfg.SecretsPath, pcr: s.cfg.SecretsPCR})
+    }
+    if err := s.files.writeFiles(pending); err != nil {
+        slog.Error("Failed to write upload", "error", err)
+        writeStoreError(w, "write", err, nil)
+        return false
+    }
+    
+    // Measure the manifests into PCR[13], the env into PCR[14] and the
+    // secrets into their PCR, in canonical order so the PCR values are
+    // reproducible. Files that aren't fully measured must never be
+    // started, so a failure removes them all again, leaving the upload
+    // to be retried once the TPM or agent is back.
+    done, err := s.measurement.measureFiles(measured)
+    if err == nil {
+        if err = s.measurement.measureSummary("upload", measured); err != nil {
+            err = fmt.Errorf("summary: %v", err)
+        }
+    }
+    if err != nil {
+        slog.Error("Failed to measure upload, removing its files", "measured", done, "error", err)
+        removeFiles(pending)
+        writeStoreError(w, "measure", err, done)
+        return false
+    }
+    
+    // Only now may the files be started, even by a restarted server
+    var written []string
+    for _, f := range pending {
+        written = append(written, f.path)
+    }
+    if err := s.state.markUploaded(written); err != nil {
+        slog.Error("Failed to persist provisioning state, removing the upload", "path", s.cfg.StatePath, "error", err)
+        removeFiles(pending)
+        writeStoreError(w, "write", fmt.Errorf("provisioning state: %v", err), done)
+        return false
+    }
+    
+    // Keep an operational record of what was provisioned and by whom
+    if err := s.audit.record(measured, r.RemoteAddr); err != nil {
+        slog.Error("Failed to append to audit log", "path", s.cfg.AuditLogPath, "error", err)
+    }
+    
+    slog.Info("Upload complete",
+        "pod_paths", podPaths,
+        "env", len(envContent) > 0,
+        "secrets", len(secretsContent) > 0,
+        "status", http.StatusCreated)
+    files := podPaths
+    if len(envContent) > 0 {
+        files = append(files, s.cfg.EnvPath)
+    }
+    if len(secretsContent) > 0 {
+        files = append(files, s.cfg.SecretsPath)
+    }
+    writeJSON(w, http.StatusCreated, uploadResponse{Files: files})
+    return true
+}
+
+// Start container handler
+func (s *Server) handleStart(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    
+    // Starting, retries and healthchecks included, may take a while
+    disableWriteTimeout(w)
+    
+    // Only one start at a time, and only once
+    s.startMu.Lock()
+    defer s.startMu.Unlock()
+    
+    // A retry with the key of an earlier request gets its response, the
+    // first request with a key has its response cached
+    if key := r.Header.Get(idempotencyKeyHeader); key != "" {
+        if len(key) > maxIdempotencyKeyLength {
+            writeError(w, fmt.Sprintf("%s exceeds %d characters", idempotencyKeyHeader, maxIdempotencyKeyLength), http.StatusBadRequest)
+            return
+        }
+        if cached, ok := s.idempotency.get(key); ok {
+            slog.Info("Replaying /start response", "status", cached.Status)
+            cached.replay(w)
+            return
+        }
+        capture := &responseCapture{ResponseWriter: w}
+        defer func() {
+            if err := s.idempotency.put(key, capture.status, capture.body.Bytes()); err != nil {
+                slog.Error("Failed to persist /start response", "path", s.cfg.StatePath, "error", err)
+            }
+        }()
+        w = capture
+    }
+    
+    // With replace=true, as a form field or in the query, the pod is
+    // recreated even if it was started before
+    r.Body = http.MaxBytesReader(w, r.Body, 1<<20)
+    replace := r.FormValue("replace") == "true"
+    if s.state.isStarted() && !replace {
+        writeError(w, "pod already started", http.StatusConflict)
+        return
+    }
+    
+    // Extra arguments to podman's play subcommand, each an allowlisted --flag=value
+    args := r.Form[startArgField]
+    if len(args) > 0 && s.podmanPath == "" {
+        writeError(w, fmt.Sprintf("Extra arguments are not supported with the %s runtime", s.cfg.Runtime), http.StatusBadRequest)
+        return
+    }
+    if err := checkStartArgs(args); err != nil {
+        writeError(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    
+    status := "started"
+    if replace {
+        status = "replaced"
+    }
+    s.startPods(w, replace, args, status)
+}
+
+// Restart handler: starts the pod again from the stored manifests and env,
+// replacing whatever is left of it, with the arguments of the last
+// successful start
+func (s *Server) handleRestart(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    
+    disableWriteTimeout(w)
+    s.startMu.Lock()
+    defer s.startMu.Unlock()
+    
+    started, args, secrets := s.state.lastStart()
+    if !started {
+        writeError(w, "pod was never started", http.StatusConflict)
+        return
+    }
+    // The secrets were shredded by the start that used them, restarting
+    // without them wouldn't be the same start
+    if secrets && !fileExists(s.cfg.SecretsPath) {
+        writeError(w, "the last start used secrets, which are gone since", http.StatusConflict)
+        return
+    }
+    s.startPods(w, true, args, "restarted")
+}
+
+// Start the stored manifests, the part /start and /restart share: measure
+// the summary, shred the secrets and record the start once the runtime
+// succeeded, then answer with status and shut down. Called with startMu
+// held.
+func (s *Server) startPods(w http.ResponseWriter, replace bool, args []string, status string) {
+    // A start queued behind the one that triggered the shutdown is too late
+    select {
+    case <-s.shutdownCh:
+        writeError(w, "server is shutting down", http.StatusServiceUnavailable)
+        return
+    default:
+    }
+
+    // Check if required files exist
+    if !fileExists(podManifestPath(s.cfg.ManifestDir, 0)) {
+        writeError(w, "pod.yaml not found", http.StatusNotFound)
+        return
+    }
+    
+    // Pass the environment file to the runtime directly, no shell involved
+    var envVars []string
+    if fileExists(s.cfg.EnvPath) {
+        var err error
+        envVars, err = parseEnvFile(s.cfg.EnvPath)
+        if err != nil {
+            writeError(w, fmt.Sprintf("Failed to parse env: %v", err), http.StatusInternalServerError)
+            return
+        }
+    }
+    secrets := s.cfg.SecretsPath != "" && fileExists(s.cfg.SecretsPath)
+    if secrets {
+        secretVars, err := parseEnvFile(s.cfg.SecretsPath)
+        if err != nil {
+            writeError(w, fmt.Sprintf("Failed to parse secrets: %v", err), http.StatusInternalServerError)
+            return
+        }
+        envVars = append(envVars, secretVars...)
+    }
+
+    // Start the manifests in the same order they were measured
+    manifests := listPodManifests(s.cfg.ManifestDir)
+    
+    // In dry-run mode only report what would be run
+    if s.cfg.DryRun {
+        commands := make([][]string, len(manifests))
+        for i, manifest := range manifests {
+            commands[i] = s.runtime.Command(manifest, replace, args)
+            slog.Info("Dry run, not starting", "pod_path", manifest, "argv", commands[i])
+        }
+        writeJSON(w, http.StatusOK, startResponse{Status: "dry-run", Manifests: manifests, Commands: commands})
+        return
+    }
+    
+    for i, manifest := range manifests {
+        started := time.Now()
+        err := startWithRetry(s.runtime, manifest, envVars, replace, args, s.cfg.StartRetries, s.cfg.StartRetryDelay)
+        duration := time.Since(started)
+        if err != nil {
+            errorMsg := fmt.Sprintf("Container start failed for %s:\n%v", filepath.Base(manifest), err)
+            reason := startFailureReason(err)
+            slog.Error("Container start failed",
+                "pod_path", manifest,
+                "duration", duration,
+                "reason", reason,
+                "error", err,
+                "status", http.StatusInternalServerError)
+            // The manifests before it are up but the start isn't recorded,
+            // a retry would fail on them as already existing. Tear down
+            // everything the runtime started so /start can be retried as a
+            // whole.
+            if i > 0 {
+                if err := s.runtime.Stop(); err != nil {
+                    slog.Error("Failed to stop the manifests started before the failure", "error", err)
+                }
+            }
+            writeJSON(w, http.StatusInternalServerError, startErrorResponse{
+                Error:  errorMsg,
+                Code:   http.StatusInternalServerError,
+                Reason: reason,
+            })
+	        // we could shutdown the server here, but I don't see any benefits
+            return
+        }
+
+        slog.Info("Container started successfully",
+            "pod_path", manifest,
+            "replace", replace,
+            "args", args,
+            "duration", duration)
+    }
+    
+    // Sum up what was started, before the secrets are gone
+    if s.measurement.summaryPCR != 0 {
+        var started []measuredFile
+        for _, manifest := range manifests {
+            started = append(started, measuredFile{path: manifest, pcr: podPCR})
+        }
+        if fileExists(s.cfg.EnvPath) {
+            started = append(started, measuredFile{path: s.cfg.EnvPath, pcr: envPCR})
+        }
+        if secrets {
+            started = append(started, measuredFile{path: s.cfg.SecretsPath, pcr: s.cfg.SecretsPCR})
+        }
+        if err := s.measurement.measureSummary("start", started); err != nil {
+            slog.Error("Failed to measure start summary", "error", err)
+        }
+    }
+    
+    // The runtime has the secrets now, don't keep them around any longer.
+    // After a failed start they are kept, so /start can be retried.
+    if secrets {
+        if err := shredFile(s.cfg.SecretsPath); err != nil {
+            slog.Error("Failed to shred secrets", "path", s.cfg.SecretsPath, "error", err)
+        }
+    }
+    
+    // Remember the pod is up, so a restarted server doesn't start it again
+    if err := s.state.markStarted(args, secrets); err != nil {
+        slog.Error("Failed to persist provisioning state", "path", s.cfg.StatePath, "error", err)
+    }
+    
+    // Optionally wait for the apps inside to pass their own healthchecks,
+    // keeping the server up if they never do
+    if s.cfg.HealthcheckTimeout > 0 && s.podmanPath != "" {
+        pods, err := podNames(s.cfg.ManifestDir)
+        if err == nil {
+            err = waitHealthy(s.podmanPath, pods, s.cfg.HealthcheckTimeout, s.cfg.HealthcheckInterval)
+        }
+        if err != nil {
+            slog.Error("Pod healthcheck failed", "error", err, "status", http.StatusInternalServerError)
+            writeError(w, fmt.Sprintf("Pod started but not healthy: %v", err), http.StatusInternalServerError)
+            return
+        }
+    }
+    
+    // Send and flush the response before triggering server shutdown, so
+    // the client sees the 200 rather than a dropped connection
+    resp := startResponse{Status: status, Manifests: manifests}
+    if s.podmanPath != "" {
+        resp.Pods = startedPods(s.podmanPath, s.cfg.ManifestDir)
+    }
+    slog.Info("Pod started", "replace", replace, "status", http.StatusOK)
+    writeJSON(w, http.StatusOK, resp)
+    if err := http.NewResponseController(w).Flush(); err != nil {
+        slog.Warn("Failed to flush /start response", "error", err)
+    }
+    close(s.shutdownCh)
+}
+
+// IDs of the pods just started from the manifests in dir and of their
+// containers. Pods that can't be inspected are reported with their error
+// rather than failing the start.
+func startedPods(podman, dir string) []podStatus {
+    names, err := podNames(dir)
+    if err != nil {
+        slog.Warn("Failed to read pod names", "error", err)
+        return nil
+    }
+    pods := []podStatus{}
+    for _, name := range names {
+        pods = append(pods, inspectPod(podman, name))
+    }
+    return pods
+}
+
+// Image pre-pull handler, so private images are fetched with their
+// credentials before /start
+func (s *Server) handlePull(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    
+    if !fileExists(podManifestPath(s.cfg.ManifestDir, 0)) {
+        writeError(w, "pod.yaml not found", http.StatusNotFound)
+        return
+    }
+    
+    // Optional credentials, as form fields so they stay out of URLs
+    r.Body = http.MaxBytesReader(w, r.Body, 1<<20)
+    if err := r.ParseMultipartForm(1 << 20); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+        writeError(w, "Failed to parse form", http.StatusBadRequest)
+        return
+    }
+    var creds *RegistryCredentials
+    username, password := r.PostFormValue("registry_username"), r.PostFormValue("registry_password")
+    if username != "" || password != "" {
+        if username == "" || password == "" {
+            writeError(w, "registry_username and registry_password must be given together", http.StatusBadRequest)
+            return
+        }
+        creds = &RegistryCredentials{Username: username, Password: password}
+    }
+    
+    images, err := storedManifestImages(s.cfg.ManifestDir)
+    if err != nil {
+        writeError(w, fmt.Sprintf("Failed to read images: %v", err), http.StatusInternalServerError)
+        return
+    }
+    
+    // Pulling large images may take a while
+    disableWriteTimeout(w)
+    
+    if s.cfg.DryRun {
+        slog.Info("Dry run, not pulling", "images", images)
+        writeJSON(w, http.StatusOK, pullResponse{Status: "dry-run", Images: images})
+        return
+    }
+    
+    for _, image := range images {
+        started := time.Now()
+        if err := s.runtime.Pull(image, creds); err != nil {
+            slog.Error("Image pull failed", "image", image, "duration", time.Since(started), "error", err)
+            writeError(w, fmt.Sprintf("Failed to pull %s:\n%v", image, err), http.StatusInternalServerError)
+            return
+        }
+        slog.Info("Image pulled", "image", image, "authenticated", creds != nil, "duration", time.Since(started))
+    }
+    writeJSON(w, http.StatusOK, pullResponse{Status: "pulled", Images: images})
+}
+
+// Liveness handler, independent of provisioning and workload state
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    writeJSON(w, http.StatusOK, healthResponse{Status: "ok"})
+}
+
+// Build info handler, for telling which provisioner build a box runs. It's
+// unauthenticated, so it only serves what New resolved and never runs podman.
+func (s *Server) handleVersion(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    resp := versionResponse{Version: version, GitCommit: gitCommit, BuildDate: buildDate}
+    if s.podmanPath != "" {
+        resp.PodmanVersion = s.podmanVersion
+        resp.PodmanPlay = s.podmanPlay
+    }
+    writeJSON(w, http.StatusOK, resp)
+}
+
+// Readiness handler, 200 only once every container of the pod is running
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    
+    if s.podmanPath == "" {
+        writeError(w, fmt.Sprintf("Readiness is not supported with the %s runtime", s.cfg.Runtime), http.StatusNotImplemented)
+        return
+    }
+    
+    names, err := podNames(s.cfg.ManifestDir)
+    if err != nil {
+        writeError(w, fmt.Sprintf("Failed to read pod names: %v", err), http.StatusInternalServerError)
+        return
+    }
+    
+    resp := readyResponse{Ready: len(names) > 0, Pods: []podStatus{}}
+    for _, name := range names {
+        status := inspectPod(s.podmanPath, name)
+        resp.Pods = append(resp.Pods, status)
+        if !status.ready() {
+            resp.Ready = false
+        }
+    }
+    
+    code := http.StatusOK
+    if !resp.Ready {
+        code = http.StatusServiceUnavailable
+    }
+    writeJSON(w, code, resp)
+}
+
+// Container listing handler, the running containers of the provisioned pods
+func (s *Server) handleContainers(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    
+    if s.podmanPath == "" {
+        writeError(w, fmt.Sprintf("Listing containers is not supported with the %s runtime", s.cfg.Runtime), http.StatusNotImplemented)
+        return
+    }
+    
+    names, err := podNames(s.cfg.ManifestDir)
+    if err != nil {
+        writeError(w, fmt.Sprintf("Failed to read pod names: %v", err), http.StatusInternalServerError)
+        return
+    }
+    
+    containers := []containerInfo{}
+    for _, name := range names {
+        podContainers, err := listContainers(s.podmanPath, name)
+        if err != nil {
+            writeError(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        containers = append(containers, podContainers...)
+    }
+    writeJSON(w, http.StatusOK, containers)
+}
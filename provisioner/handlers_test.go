@@ -0,0 +1,894 @@
+package provisioner
+
+import (
+    "bytes"
+    "crypto"
+    "crypto/ed25519"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "slices"
+    "strings"
+    "syscall"
+    "testing"
+    "time"
+
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/require"
+    "gopkg.in/yaml.v3"
+)
+
+func TestUploadEnvWriteFailureLeavesNothingBehind(t *testing.T) {
+    ts := newTestServer(t, nil)
+    ts.files.rename = func(oldpath, newpath string) error {
+        if newpath == ts.cfg.EnvPath {
+            return renameError(oldpath, newpath, syscall.EROFS)
+        }
+        return os.Rename(oldpath, newpath)
+    }
+
+    upload := func() *httptest.ResponseRecorder {
+        return ts.do(multipartRequest(t, "/upload",
+            formPart{field: "pod.yaml", content: testManifest},
+            formPart{field: "env", content: "FOO=bar\n"}))
+    }
+    resp := upload()
+    require.Equal(t, http.StatusInternalServerError, resp.Code)
+    var body storeErrorResponse
+    require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &body))
+    assert.Equal(t, "write", body.Stage)
+    assert.Empty(t, body.Measured)
+    assert.NoFileExists(t, podManifestPath(ts.cfg.ManifestDir, 0))
+    assert.NoFileExists(t, ts.cfg.EnvPath)
+    assert.Empty(t, ts.measurer.paths())
+
+    // Nothing is left to conflict with a retry
+    ts.files.rename = os.Rename
+    resp = upload()
+    require.Equal(t, http.StatusCreated, resp.Code, resp.Body.String())
+    assert.Equal(t, []string{podManifestPath(ts.cfg.ManifestDir, 0), ts.cfg.EnvPath}, ts.measurer.paths())
+}
+
+func TestUploadWaitsForRunningStart(t *testing.T) {
+    ts := newTestServer(t, nil)
+
+    req := multipartRequest(t, "/upload", formPart{field: "pod.yaml", content: testManifest})
+    ts.startMu.Lock()
+    done := make(chan *httptest.ResponseRecorder)
+    go func() {
+        done <- ts.do(req)
+    }()
+    select {
+    case <-done:
+        t.Fatal("upload finished while a start held the lock")
+    case <-time.After(100 * time.Millisecond):
+    }
+    assert.NoFileExists(t, podManifestPath(ts.cfg.ManifestDir, 0))
+    assert.Empty(t, ts.measurer.paths())
+
+    ts.startMu.Unlock()
+    resp := <-done
+    assert.Equal(t, http.StatusCreated, resp.Code, resp.Body.String())
+    assert.FileExists(t, podManifestPath(ts.cfg.ManifestDir, 0))
+}
+
+func TestConcurrentUploadsConflict(t *testing.T) {
+    ts := newTestServer(t, nil)
+
+    // Both get past the early conflict check while a start holds the lock
+    ts.startMu.Lock()
+    done := make(chan *httptest.ResponseRecorder)
+    for _, content := range []string{testManifest, testManifest + "# second\n"} {
+        req := multipartRequest(t, "/upload", formPart{field: "pod.yaml", content: content})
+        go func() {
+            done <- ts.do(req)
+        }()
+    }
+    time.Sleep(100 * time.Millisecond)
+    ts.startMu.Unlock()
+
+    codes := []int{(<-done).Code, (<-done).Code}
+    assert.ElementsMatch(t, []int{http.StatusCreated, http.StatusConflict}, codes)
+    assert.Equal(t, []string{podManifestPath(ts.cfg.ManifestDir, 0)}, ts.measurer.paths())
+}
+
+func TestManifestsMeasuredAndStartedInIndexOrder(t *testing.T) {
+    ts := newTestServer(t, nil)
+    manifest := func(name string) string {
+        return strings.ReplaceAll(testManifest, "web", name)
+    }
+
+    resp := ts.do(multipartRequest(t, "/upload",
+        formPart{field: "pod.yaml.2", content: manifest("third")},
+        formPart{field: "pod.yaml", content: manifest("first")},
+        formPart{field: "pod.yaml.1", content: manifest("second")}))
+    require.Equal(t, http.StatusCreated, resp.Code, resp.Body.String())
+
+    want := []string{
+        podManifestPath(ts.cfg.ManifestDir, 0),
+        podManifestPath(ts.cfg.ManifestDir, 1),
+        podManifestPath(ts.cfg.ManifestDir, 2),
+    }
+    assert.Equal(t, want, ts.measurer.paths())
+    data, err := os.ReadFile(want[1])
+    require.NoError(t, err)
+    assert.Equal(t, manifest("second"), string(data))
+
+    resp = ts.do(httptest.NewRequest(http.MethodPost, "/start", nil))
+    require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+    assert.Equal(t, want, ts.playedManifests(t))
+}
+
+func TestFailedStartStopsEarlierManifests(t *testing.T) {
+    ts := newTestServer(t, nil)
+    manifest := func(name string) string {
+        return strings.ReplaceAll(testManifest, "web", name)
+    }
+    resp := ts.do(multipartRequest(t, "/upload",
+        formPart{field: "pod.yaml", content: manifest("first")},
+        formPart{field: "pod.yaml.1", content: manifest("second")},
+        formPart{field: "pod.yaml.2", content: manifest("third")}))
+    require.Equal(t, http.StatusCreated, resp.Code, resp.Body.String())
+
+    // Playing the third manifest fails, tearing down succeeds
+    ts.setPodman(t, `#!/bin/sh
+echo "$*" >> "$(dirname "$0")/calls.log"
+case "$*" in
+*--down*) exit 0 ;;
+*/pod.2.yaml) echo "Error: invalid manifest" >&2; exit 125 ;;
+esac
+exit 0
+`)
+    resp = ts.do(httptest.NewRequest(http.MethodPost, "/start", nil))
+    require.Equal(t, http.StatusInternalServerError, resp.Code, resp.Body.String())
+
+    var downed []string
+    for _, call := range ts.podmanCalls(t) {
+        if argv := strings.Fields(call); slices.Contains(argv, "--down") {
+            downed = append(downed, argv[len(argv)-1])
+        }
+    }
+    assert.Equal(t, []string{podManifestPath(ts.cfg.ManifestDir, 1), podManifestPath(ts.cfg.ManifestDir, 0)}, downed)
+    assert.False(t, ts.state.isStarted())
+}
+
+func TestUploadMeasuresInCanonicalOrder(t *testing.T) {
+    ts := newTestServer(t, nil)
+    resp := ts.do(multipartRequest(t, "/upload",
+        formPart{field: "env", content: "FOO=bar\n"},
+        formPart{field: "pod.yaml.1", content: strings.ReplaceAll(testManifest, "web", "second")},
+        formPart{field: "pod.yaml", content: testManifest}))
+    require.Equal(t, http.StatusCreated, resp.Code, resp.Body.String())
+
+    want := []string{podManifestPath(ts.cfg.ManifestDir, 0), podManifestPath(ts.cfg.ManifestDir, 1), ts.cfg.EnvPath}
+    assert.Equal(t, want, ts.measurer.paths())
+
+    // The event log tells verifiers the same order and PCRs
+    data, err := os.ReadFile(ts.cfg.EventLogPath)
+    require.NoError(t, err)
+    var logged []string
+    var pcrs []int
+    for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+        var event measurementEvent
+        require.NoError(t, json.Unmarshal([]byte(line), &event))
+        require.NotNil(t, event.PCR)
+        logged = append(logged, event.Path)
+        pcrs = append(pcrs, *event.PCR)
+    }
+    assert.Equal(t, want, logged)
+    assert.Equal(t, []int{podPCR, podPCR, envPCR}, pcrs)
+}
+
+// A DSSE envelope of payload signed with key
+func signedEnvelope(t *testing.T, key ed25519.PrivateKey, payload string) string {
+    const payloadType = "application/yaml"
+    sig := ed25519.Sign(key, dssePAE(payloadType, []byte(payload)))
+    data, err := json.Marshal(dsseEnvelope{
+        PayloadType: payloadType,
+        Payload:     base64.StdEncoding.EncodeToString([]byte(payload)),
+        Signatures:  []dsseSignature{{Sig: base64.StdEncoding.EncodeToString(sig)}},
+    })
+    require.NoError(t, err)
+    return string(data)
+}
+
+func TestUploadRejectsEmptyFiles(t *testing.T) {
+    public, private, err := ed25519.GenerateKey(nil)
+    require.NoError(t, err)
+
+    tests := []struct {
+        name      string
+        envelopes bool
+        parts     []formPart
+        want      string
+    }{
+        {"pod.yaml", false, []formPart{{field: "pod.yaml"}}, "manifest is empty"},
+        {"env", false, []formPart{{field: "pod.yaml", content: testManifest}, {field: "env"}}, "env is empty"},
+        {"envelope payload", true, []formPart{{field: "pod.yaml", content: signedEnvelope(t, private, "")}}, "manifest is empty"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            ts := newTestServer(t, nil)
+            if tt.envelopes {
+                ts.envelopeKeys = []crypto.PublicKey{public}
+            }
+
+            resp := ts.do(multipartRequest(t, "/upload", tt.parts...))
+            require.Equal(t, http.StatusBadRequest, resp.Code, resp.Body.String())
+            var body errorResponse
+            require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &body))
+            assert.Contains(t, body.Error, tt.want)
+            assert.NoFileExists(t, podManifestPath(ts.cfg.ManifestDir, 0))
+            assert.NoFileExists(t, podManifestPath(ts.cfg.ManifestDir, 0)+envelopeSuffix)
+            assert.NoFileExists(t, ts.cfg.EnvPath)
+            assert.Empty(t, ts.measurer.paths())
+        })
+    }
+}
+
+func TestUploadWriteAndMeasureFailures(t *testing.T) {
+    upload := func(t *testing.T, ts *testServer) storeErrorResponse {
+        resp := ts.do(multipartRequest(t, "/upload",
+            formPart{field: "pod.yaml", content: testManifest},
+            formPart{field: "env", content: "FOO=bar\n"}))
+        var body storeErrorResponse
+        require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &body))
+        assert.Equal(t, resp.Code, body.Code)
+        return body
+    }
+
+    t.Run("write", func(t *testing.T) {
+        ts := newTestServer(t, nil)
+        ts.files.rename = func(oldpath, newpath string) error {
+            return renameError(oldpath, newpath, syscall.ENOSPC)
+        }
+        body := upload(t, ts)
+        assert.Equal(t, http.StatusInternalServerError, body.Code)
+        assert.Equal(t, "write", body.Stage)
+        assert.Contains(t, body.Error, "Failed to write")
+        assert.Contains(t, body.Error, syscall.ENOSPC.Error())
+        assert.Empty(t, body.Measured)
+        assert.Empty(t, ts.measurer.paths())
+        assert.NoFileExists(t, podManifestPath(ts.cfg.ManifestDir, 0))
+    })
+
+    t.Run("measure", func(t *testing.T) {
+        ts := newTestServer(t, nil)
+        ts.measurer.fail = func(path string) error {
+            if path == ts.cfg.EnvPath {
+                return errors.New("agent unavailable")
+            }
+            return nil
+        }
+        body := upload(t, ts)
+        assert.Equal(t, http.StatusServiceUnavailable, body.Code)
+        assert.Equal(t, "measure", body.Stage)
+        assert.Contains(t, body.Error, "Failed to measure")
+        assert.Contains(t, body.Error, "agent unavailable")
+        assert.Equal(t, []string{podManifestPath(ts.cfg.ManifestDir, 0)}, body.Measured)
+        // Nothing that isn't fully measured is kept for a start
+        assert.NoFileExists(t, podManifestPath(ts.cfg.ManifestDir, 0))
+        assert.NoFileExists(t, ts.cfg.EnvPath)
+
+        ts.measurer.fail = nil
+        resp := ts.do(multipartRequest(t, "/upload", formPart{field: "pod.yaml", content: testManifest}))
+        assert.Equal(t, http.StatusCreated, resp.Code, resp.Body.String())
+    })
+}
+
+func TestMeasureRefusesReservedNames(t *testing.T) {
+    ts := newTestServer(t, func(cfg *Config) {
+        cfg.MeasureDir = t.TempDir()
+    })
+    for _, name := range []string{"pod.yaml", "pod.3.yaml", "pod.yaml.dsse", "env", "provisioner-state.json", "audit.log"} {
+        resp := ts.do(multipartRequest(t, "/measure",
+            formPart{field: measureFileField, filename: name, content: "data"},
+            formPart{field: measurePCRField, content: "16", value: true}))
+        assert.Equal(t, http.StatusBadRequest, resp.Code, name)
+        assert.NoFileExists(t, filepath.Join(ts.cfg.MeasureDir, name))
+    }
+    assert.Empty(t, ts.measurer.paths())
+
+    resp := ts.do(multipartRequest(t, "/measure",
+        formPart{field: measureFileField, filename: "policy.tmpl", content: "data"},
+        formPart{field: measurePCRField, content: "16", value: true}))
+    assert.Equal(t, http.StatusCreated, resp.Code, resp.Body.String())
+}
+
+func TestConcurrentMeasuresOfOneName(t *testing.T) {
+    ts := newTestServer(t, func(cfg *Config) {
+        cfg.MeasureDir = t.TempDir()
+    })
+
+    // Both get past the early check while the lock is held
+    ts.startMu.Lock()
+    done := make(chan *httptest.ResponseRecorder)
+    for _, content := range []string{"first", "second"} {
+        req := multipartRequest(t, "/measure",
+            formPart{field: measureFileField, filename: "policy.json", content: content},
+            formPart{field: measurePCRField, content: "16", value: true})
+        go func() {
+            done <- ts.do(req)
+        }()
+    }
+    time.Sleep(100 * time.Millisecond)
+    ts.startMu.Unlock()
+
+    codes := []int{(<-done).Code, (<-done).Code}
+    assert.ElementsMatch(t, []int{http.StatusCreated, http.StatusConflict}, codes)
+    assert.Len(t, ts.measurer.paths(), 1)
+}
+
+func TestValidateRunsUploadChecks(t *testing.T) {
+    ts := newTestServer(t, func(cfg *Config) {
+        cfg.AllowedRegistries = []string{"registry.example.com/"}
+    })
+    played := func() int {
+        n := 0
+        for _, call := range ts.podmanCalls(t) {
+            if strings.Contains(call, "--start=false") {
+                n++
+            }
+        }
+        return n
+    }
+
+    // An image from a registry that isn't allowed is never pulled
+    resp := ts.do(multipartRequest(t, "/validate", formPart{field: "pod.yaml", content: testManifest}))
+    assert.Equal(t, http.StatusForbidden, resp.Code, resp.Body.String())
+    assert.Contains(t, resp.Body.String(), "docker.io/library/nginx:latest")
+    resp = ts.do(multipartRequest(t, "/upload", formPart{field: "pod.yaml", content: testManifest}))
+    assert.Equal(t, http.StatusForbidden, resp.Code, resp.Body.String())
+
+    // Neither is a kind that isn't allowed
+    namespace := "apiVersion: v1\nkind: Namespace\nmetadata:\n  name: other\n"
+    resp = ts.do(multipartRequest(t, "/validate", formPart{field: "pod.yaml", content: namespace}))
+    assert.Equal(t, http.StatusBadRequest, resp.Code, resp.Body.String())
+    assert.Zero(t, played())
+
+    allowed := strings.ReplaceAll(testManifest, "docker.io/library/", "registry.example.com/")
+    resp = ts.do(multipartRequest(t, "/validate", formPart{field: "pod.yaml", content: allowed}))
+    assert.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+    assert.Equal(t, 1, played())
+}
+
+func TestCheckStartArgs(t *testing.T) {
+    tests := []struct {
+        arg   string
+        valid bool
+    }{
+        {"--network=backend", true},
+        {"--network=host", false},
+        {"--network=none", false},
+        {"--network=container:abc123", false},
+        {"--network=ns:/proc/1/ns/net", false},
+        {"--network", false},
+        {"--log-driver=journald", true},
+        {"--log-opt=max-size=10mb", true},
+        {"--log-opt=tag=web", true},
+        {"--log-opt=path=/etc/cron.d/x", false},
+        {"--log-opt=max-size", false},
+        {"--log-level=debug", true},
+        {"--log-level=loud", false},
+        {"--annotation=io.example/team=infra", true},
+        {"--annotation==x", false},
+        {"--annotation=a=$(id)", false},
+        {"--privileged=true", false},
+        {"--replace", false},
+    }
+    for _, tt := range tests {
+        err := checkStartArgs([]string{tt.arg})
+        if tt.valid {
+            assert.NoError(t, err, tt.arg)
+        } else {
+            assert.Error(t, err, tt.arg)
+        }
+    }
+}
+
+func TestForcedEnvRestoredWhenMeasureFails(t *testing.T) {
+    ts := newTestServer(t, nil)
+    resp := ts.do(multipartRequest(t, "/upload",
+        formPart{field: "pod.yaml", content: testManifest},
+        formPart{field: "env", content: "FOO=bar\n"}))
+    require.Equal(t, http.StatusCreated, resp.Code, resp.Body.String())
+
+    ts.measurer.fail = func(path string) error {
+        return errors.New("agent unavailable")
+    }
+    resp = ts.do(multipartRequest(t, "/env",
+        formPart{field: "env", content: "FOO=new\n"},
+        formPart{field: "force", content: "true", value: true}))
+    require.Equal(t, http.StatusServiceUnavailable, resp.Code, resp.Body.String())
+
+    // The measured env is back, for this server and a restarted one
+    data, err := os.ReadFile(ts.cfg.EnvPath)
+    require.NoError(t, err)
+    assert.Equal(t, "FOO=bar\n", string(data))
+    newTestServerFrom(t, ts.cfg)
+    assert.FileExists(t, ts.cfg.EnvPath)
+}
+
+// Start a resumable upload of content, returning its id
+func initResumable(t *testing.T, ts *testServer, content string) string {
+    digest := sha256.Sum256([]byte(content))
+    target := fmt.Sprintf("/upload/init?size=%d&sha256=%x", len(content), digest)
+    resp := ts.do(httptest.NewRequest(http.MethodPost, target, nil))
+    require.Equal(t, http.StatusCreated, resp.Code, resp.Body.String())
+    var body resumableResponse
+    require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &body))
+    assert.Equal(t, int64(len(content)), body.Size)
+    assert.Zero(t, body.Offset)
+    return body.ID
+}
+
+// Send bytes first..last of content as one chunk
+func putChunk(ts *testServer, id, content string, first, last int) *httptest.ResponseRecorder {
+    req := httptest.NewRequest(http.MethodPut, fmt.Sprintf("/upload/%s?offset=%d", id, first), strings.NewReader(content[first:last+1]))
+    req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", first, last, len(content)))
+    return ts.do(req)
+}
+
+func resumableOffset(t *testing.T, resp *httptest.ResponseRecorder) int64 {
+    var body resumableResponse
+    require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &body))
+    return body.Offset
+}
+
+func TestResumableUpload(t *testing.T) {
+    ts := newTestServer(t, nil)
+    id := initResumable(t, ts, testManifest)
+    half := len(testManifest) / 2
+
+    resp := putChunk(ts, id, testManifest, 0, half-1)
+    require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+    assert.Equal(t, int64(half), resumableOffset(t, resp))
+
+    // A commit before everything arrived is refused
+    resp = ts.do(httptest.NewRequest(http.MethodPost, "/upload/"+id+"/commit", nil))
+    assert.Equal(t, http.StatusConflict, resp.Code, resp.Body.String())
+
+    // Resending the first chunk, as a client that lost the response
+    // would, tells it where to resume
+    resp = putChunk(ts, id, testManifest, 0, half-1)
+    require.Equal(t, http.StatusConflict, resp.Code, resp.Body.String())
+    offset := int(resumableOffset(t, resp))
+    resp = ts.do(httptest.NewRequest(http.MethodGet, "/upload/"+id, nil))
+    require.Equal(t, http.StatusOK, resp.Code)
+    assert.Equal(t, int64(offset), resumableOffset(t, resp))
+
+    resp = putChunk(ts, id, testManifest, offset, len(testManifest)-1)
+    require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+
+    resp = ts.do(multipartRequest(t, "/upload/"+id+"/commit", formPart{field: "env", content: "FOO=bar\n"}))
+    require.Equal(t, http.StatusCreated, resp.Code, resp.Body.String())
+    data, err := os.ReadFile(podManifestPath(ts.cfg.ManifestDir, 0))
+    require.NoError(t, err)
+    assert.Equal(t, testManifest, string(data))
+    assert.Equal(t, []string{podManifestPath(ts.cfg.ManifestDir, 0), ts.cfg.EnvPath}, ts.measurer.paths())
+
+    // A committed upload is gone
+    resp = ts.do(httptest.NewRequest(http.MethodGet, "/upload/"+id, nil))
+    assert.Equal(t, http.StatusNotFound, resp.Code)
+}
+
+func TestResumableUploadSHA256Mismatch(t *testing.T) {
+    ts := newTestServer(t, nil)
+    id := initResumable(t, ts, testManifest)
+    corrupted := strings.Replace(testManifest, "web", "bad", 1)
+    resp := putChunk(ts, id, corrupted, 0, len(corrupted)-1)
+    require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+
+    resp = ts.do(httptest.NewRequest(http.MethodPost, "/upload/"+id+"/commit", nil))
+    assert.Equal(t, http.StatusUnprocessableEntity, resp.Code, resp.Body.String())
+    assert.NoFileExists(t, podManifestPath(ts.cfg.ManifestDir, 0))
+    assert.Empty(t, ts.measurer.paths())
+
+    // It has to be sent again from scratch
+    resp = ts.do(httptest.NewRequest(http.MethodGet, "/upload/"+id, nil))
+    assert.Equal(t, http.StatusNotFound, resp.Code)
+}
+
+func TestResumableCommitRetriedAfterMeasureFailure(t *testing.T) {
+    ts := newTestServer(t, nil)
+    id := initResumable(t, ts, testManifest)
+    resp := putChunk(ts, id, testManifest, 0, len(testManifest)-1)
+    require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+
+    ts.measurer.fail = func(path string) error {
+        return errors.New("agent unavailable")
+    }
+    resp = ts.do(httptest.NewRequest(http.MethodPost, "/upload/"+id+"/commit", nil))
+    require.Equal(t, http.StatusServiceUnavailable, resp.Code, resp.Body.String())
+
+    // The upload is still there, a retry needs no resending
+    ts.measurer.fail = nil
+    resp = ts.do(httptest.NewRequest(http.MethodPost, "/upload/"+id+"/commit", nil))
+    require.Equal(t, http.StatusCreated, resp.Code, resp.Body.String())
+    assert.FileExists(t, podManifestPath(ts.cfg.ManifestDir, 0))
+}
+
+func TestMultipartFormLimits(t *testing.T) {
+    oversized := strings.Repeat("x", 2048)
+    tests := []struct {
+        target string
+        part   formPart
+    }{
+        {"/upload", formPart{field: "pod.yaml", content: oversized}},
+        {"/env", formPart{field: "env", content: oversized}},
+        {"/measure", formPart{field: measureFileField, content: oversized}},
+        {"/validate", formPart{field: "pod.yaml", content: oversized}},
+    }
+    for _, tt := range tests {
+        t.Run(tt.target, func(t *testing.T) {
+            ts := newTestServer(t, func(cfg *Config) {
+                cfg.MaxUploadBytes = 1024
+                cfg.MeasureDir = t.TempDir()
+            })
+            resp := ts.do(multipartRequest(t, tt.target, tt.part))
+            assert.Equal(t, http.StatusRequestEntityTooLarge, resp.Code, resp.Body.String())
+            assert.Empty(t, ts.measurer.paths())
+        })
+    }
+}
+
+func TestNonMultipartBodyReportsMissingParts(t *testing.T) {
+    tests := []struct {
+        target string
+        want   string
+    }{
+        {"/upload", "pod.yaml is required"},
+        {"/env", "env must be sent exactly once"},
+        {"/measure", measureFileField + " must be sent exactly once"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.target, func(t *testing.T) {
+            ts := newTestServer(t, func(cfg *Config) {
+                cfg.MeasureDir = t.TempDir()
+            })
+            req := httptest.NewRequest(http.MethodPost, tt.target, strings.NewReader("FOO=bar\n"))
+            req.Header.Set("Content-Type", "text/plain")
+            resp := ts.do(req)
+            require.Equal(t, http.StatusBadRequest, resp.Code, resp.Body.String())
+            var body errorResponse
+            require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &body))
+            assert.Equal(t, tt.want, body.Error)
+        })
+    }
+}
+
+func TestUploadEnvelopes(t *testing.T) {
+    trusted, private, err := ed25519.GenerateKey(nil)
+    require.NoError(t, err)
+    _, untrusted, err := ed25519.GenerateKey(nil)
+    require.NoError(t, err)
+
+    // Envelope of payload signed by key, with the payload and signature
+    // in the given base64 alphabet
+    envelope := func(key ed25519.PrivateKey, payloadType, payload string, encoding *base64.Encoding) string {
+        sig := ed25519.Sign(key, dssePAE(payloadType, []byte(payload)))
+        data, err := json.Marshal(dsseEnvelope{
+            PayloadType: payloadType,
+            Payload:     encoding.EncodeToString([]byte(payload)),
+            Signatures:  []dsseSignature{{Sig: encoding.EncodeToString(sig)}},
+        })
+        require.NoError(t, err)
+        return string(data)
+    }
+    // Any six bytes hold an aligned "???", which encodes to "Pz8/"
+    urlSafe := testManifest + "# ??????\n"
+    require.Contains(t, base64.URLEncoding.EncodeToString([]byte(urlSafe)), "_")
+    tampered := strings.Replace(envelope(private, "application/yaml", testManifest, base64.StdEncoding), `"sig":"`, `"sig":"AAAA`, 1)
+
+    tests := []struct {
+        name     string
+        manifest string
+        payload  string
+        code     int
+        want     string
+    }{
+        {"valid", envelope(private, "application/yaml", testManifest, base64.StdEncoding), testManifest, http.StatusCreated, ""},
+        {"url-safe base64", envelope(private, "application/yaml", urlSafe, base64.URLEncoding), urlSafe, http.StatusCreated, ""},
+        {"invalid signature", tampered, "", http.StatusForbidden, errInvalidSignature.Error()},
+        {"untrusted key", envelope(untrusted, "application/yaml", testManifest, base64.StdEncoding), "", http.StatusForbidden, errInvalidSignature.Error()},
+        {"unsupported payload type", envelope(private, "text/plain", testManifest, base64.StdEncoding), "", http.StatusBadRequest, `unsupported payload type "text/plain"`},
+        {"not an envelope", testManifest, "", http.StatusBadRequest, "invalid envelope"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            ts := newTestServer(t, nil)
+            ts.envelopeKeys = []crypto.PublicKey{trusted}
+
+            resp := ts.do(multipartRequest(t, "/upload", formPart{field: "pod.yaml", content: tt.manifest}))
+            require.Equal(t, tt.code, resp.Code, resp.Body.String())
+            podPath := podManifestPath(ts.cfg.ManifestDir, 0)
+            if tt.code != http.StatusCreated {
+                var body errorResponse
+                require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &body))
+                assert.Contains(t, body.Error, tt.want)
+                assert.NoFileExists(t, podPath)
+                assert.NoFileExists(t, podPath+envelopeSuffix)
+                assert.Empty(t, ts.measurer.paths())
+                return
+            }
+
+            // The payload is written and measured, the envelope kept next
+            // to it as sent
+            written, err := os.ReadFile(podPath)
+            require.NoError(t, err)
+            assert.Equal(t, tt.payload, string(written))
+            stored, err := os.ReadFile(podPath + envelopeSuffix)
+            require.NoError(t, err)
+            assert.Equal(t, tt.manifest, string(stored))
+            assert.Contains(t, ts.measurer.paths(), podPath)
+        })
+    }
+}
+
+func TestUploadExpand(t *testing.T) {
+    template := strings.ReplaceAll(testManifest, "docker.io/library/nginx:latest", "${IMAGE}:$TAG")
+    expanded := strings.ReplaceAll(testManifest, "nginx:latest", "nginx:1.27")
+
+    tests := []struct {
+        name  string
+        parts []formPart
+        code  int
+        want  string
+    }{
+        {"expanded", []formPart{
+            {field: "pod.yaml", content: template},
+            {field: "env", content: "IMAGE=docker.io/library/nginx\nTAG=1.27\n"},
+            {field: "expand", content: "true", value: true},
+        }, http.StatusCreated, expanded},
+        {"not asked for", []formPart{
+            {field: "pod.yaml", content: template},
+            {field: "env", content: "IMAGE=docker.io/library/nginx\nTAG=1.27\n"},
+        }, http.StatusCreated, template},
+        {"unset variables", []formPart{
+            {field: "pod.yaml", content: template + "# $IMAGE $MISSING ${OTHER} $MISSING\n"},
+            {field: "env", content: "IMAGE=docker.io/library/nginx\n"},
+            {field: "expand", content: "true", value: true},
+        }, http.StatusBadRequest, "pod.yaml: unset variables: TAG, MISSING, OTHER"},
+        {"no env", []formPart{
+            {field: "pod.yaml", content: template},
+            {field: "expand", content: "true", value: true},
+        }, http.StatusBadRequest, "pod.yaml: unset variables: IMAGE, TAG"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            ts := newTestServer(t, nil)
+            resp := ts.do(multipartRequest(t, "/upload", tt.parts...))
+            require.Equal(t, tt.code, resp.Code, resp.Body.String())
+            podPath := podManifestPath(ts.cfg.ManifestDir, 0)
+            if tt.code != http.StatusCreated {
+                var body errorResponse
+                require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &body))
+                assert.Equal(t, tt.want, body.Error)
+                assert.NoFileExists(t, podPath)
+                assert.Empty(t, ts.measurer.paths())
+                return
+            }
+
+            // What was expanded is what gets written and measured
+            written, err := os.ReadFile(podPath)
+            require.NoError(t, err)
+            assert.Equal(t, tt.want, string(written))
+            assert.Contains(t, ts.measurer.paths(), podPath)
+        })
+    }
+}
+
+func TestUploadExpandRefusesEnvelopes(t *testing.T) {
+    public, private, err := ed25519.GenerateKey(nil)
+    require.NoError(t, err)
+    ts := newTestServer(t, nil)
+    ts.envelopeKeys = []crypto.PublicKey{public}
+
+    resp := ts.do(multipartRequest(t, "/upload",
+        formPart{field: "pod.yaml", content: signedEnvelope(t, private, testManifest)},
+        formPart{field: "expand", content: "true", value: true}))
+    require.Equal(t, http.StatusBadRequest, resp.Code, resp.Body.String())
+    assert.Contains(t, resp.Body.String(), "expand can't be used with signed envelopes")
+    assert.NoFileExists(t, podManifestPath(ts.cfg.ManifestDir, 0))
+}
+
+func TestUploadRewritesPodNameAndNamespace(t *testing.T) {
+    configMap := "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: settings\ndata:\n  mode: prod\n"
+    twoPods := testManifest + "---\n" + strings.ReplaceAll(testManifest, "web", "second")
+
+    // Name and namespace of each document of a manifest
+    metadata := func(t *testing.T, data []byte) [][2]string {
+        var found [][2]string
+        decoder := yaml.NewDecoder(bytes.NewReader(data))
+        for {
+            var doc struct {
+                Metadata struct {
+                    Name      string `yaml:"name"`
+                    Namespace string `yaml:"namespace"`
+                } `yaml:"metadata"`
+            }
+            err := decoder.Decode(&doc)
+            if errors.Is(err, io.EOF) {
+                return found
+            }
+            require.NoError(t, err)
+            found = append(found, [2]string{doc.Metadata.Name, doc.Metadata.Namespace})
+        }
+    }
+
+    tests := []struct {
+        name     string
+        manifest string
+        fields   map[string]string
+        code     int
+        want     [][2]string
+        err      string
+    }{
+        {"pod name", testManifest + "---\n" + configMap, map[string]string{"pod_name": "renamed"}, http.StatusCreated,
+            [][2]string{{"renamed", ""}, {"settings", ""}}, ""},
+        {"namespace", testManifest + "---\n" + configMap, map[string]string{"namespace": "staging"}, http.StatusCreated,
+            [][2]string{{"web", "staging"}, {"settings", "staging"}}, ""},
+        {"both", testManifest, map[string]string{"pod_name": "renamed", "namespace": "staging"}, http.StatusCreated,
+            [][2]string{{"renamed", "staging"}}, ""},
+        {"invalid pod name", testManifest, map[string]string{"pod_name": "Not_A-Label"}, http.StatusBadRequest,
+            nil, `"Not_A-Label" is not a valid DNS-1123 label`},
+        {"too long namespace", testManifest, map[string]string{"namespace": strings.Repeat("a", 64)}, http.StatusBadRequest,
+            nil, "is not a valid DNS-1123 label"},
+        {"two pods", twoPods, map[string]string{"pod_name": "renamed"}, http.StatusBadRequest,
+            nil, "pod_name needs exactly one Pod or Deployment in the manifests, found 2"},
+        {"no pod", configMap, map[string]string{"pod_name": "renamed"}, http.StatusBadRequest,
+            nil, "pod_name needs exactly one Pod or Deployment in the manifests, found 0"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            ts := newTestServer(t, nil)
+            parts := []formPart{{field: "pod.yaml", content: tt.manifest}}
+            for field, value := range tt.fields {
+                parts = append(parts, formPart{field: field, content: value, value: true})
+            }
+            resp := ts.do(multipartRequest(t, "/upload", parts...))
+            require.Equal(t, tt.code, resp.Code, resp.Body.String())
+            podPath := podManifestPath(ts.cfg.ManifestDir, 0)
+            if tt.code != http.StatusCreated {
+                var body errorResponse
+                require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &body))
+                assert.Contains(t, body.Error, tt.err)
+                assert.NoFileExists(t, podPath)
+                assert.Empty(t, ts.measurer.paths())
+                return
+            }
+
+            // The rewritten manifest is what gets written and measured
+            written, err := os.ReadFile(podPath)
+            require.NoError(t, err)
+            assert.Equal(t, tt.want, metadata(t, written))
+            assert.Contains(t, string(written), "image: docker.io/library/nginx:latest")
+            assert.Contains(t, ts.measurer.paths(), podPath)
+        })
+    }
+}
+
+func TestUploadRewriteRefusesEnvelopes(t *testing.T) {
+    public, private, err := ed25519.GenerateKey(nil)
+    require.NoError(t, err)
+    ts := newTestServer(t, nil)
+    ts.envelopeKeys = []crypto.PublicKey{public}
+
+    resp := ts.do(multipartRequest(t, "/upload",
+        formPart{field: "pod.yaml", content: signedEnvelope(t, private, testManifest)},
+        formPart{field: "namespace", content: "staging", value: true}))
+    require.Equal(t, http.StatusBadRequest, resp.Code, resp.Body.String())
+    assert.Contains(t, resp.Body.String(), "pod_name and namespace can't be used with signed envelopes")
+    assert.NoFileExists(t, podManifestPath(ts.cfg.ManifestDir, 0))
+}
+
+func TestUploadAllowedRegistries(t *testing.T) {
+    withImages := func(name string, images ...string) string {
+        manifest := fmt.Sprintf("apiVersion: v1\nkind: Pod\nmetadata:\n  name: %s\nspec:\n  initContainers:\n  - name: init\n    image: %s\n  containers:\n", name, images[0])
+        for i, image := range images[1:] {
+            manifest += fmt.Sprintf("  - name: c%d\n    image: %s\n", i, image)
+        }
+        return manifest
+    }
+
+    tests := []struct {
+        name  string
+        parts []formPart
+        code  int
+        want  string
+    }{
+        {"allowed", []formPart{
+            {field: "pod.yaml", content: withImages("web", "registry.example.com/init:1", "ghcr.io/flashbots/app:2")},
+        }, http.StatusCreated, ""},
+        {"every offending image listed", []formPart{
+            {field: "pod.yaml", content: withImages("web", "docker.io/library/busybox", "registry.example.com/app:1", "quay.io/other:3")},
+            {field: "pod.yaml.1", content: withImages("second", "registry.example.com/init:1", "nginx:latest")},
+        }, http.StatusForbidden, "Images from registries that are not allowed: docker.io/library/busybox, quay.io/other:3, nginx:latest"},
+        {"prefix, not substring", []formPart{
+            {field: "pod.yaml", content: withImages("web", "evil.io/registry.example.com/init:1", "registry.example.com/app:1")},
+        }, http.StatusForbidden, "Images from registries that are not allowed: evil.io/registry.example.com/init:1"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            ts := newTestServer(t, func(cfg *Config) {
+                cfg.AllowedRegistries = []string{"registry.example.com/", "ghcr.io/flashbots/"}
+            })
+            resp := ts.do(multipartRequest(t, "/upload", tt.parts...))
+            require.Equal(t, tt.code, resp.Code, resp.Body.String())
+            if tt.code == http.StatusCreated {
+                assert.FileExists(t, podManifestPath(ts.cfg.ManifestDir, 0))
+                return
+            }
+            var body errorResponse
+            require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &body))
+            assert.Equal(t, tt.want, body.Error)
+            assert.NoFileExists(t, podManifestPath(ts.cfg.ManifestDir, 0))
+            assert.NoFileExists(t, podManifestPath(ts.cfg.ManifestDir, 1))
+            assert.Empty(t, ts.measurer.paths())
+        })
+    }
+}
+
+func TestUploadDocumentLimits(t *testing.T) {
+    configMap := "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: settings\n"
+    namespace := "apiVersion: v1\nkind: Namespace\nmetadata:\n  name: other\n"
+
+    tests := []struct {
+        name      string
+        configure func(*Config)
+        parts     []formPart
+        want      string
+    }{
+        {"within limit", nil, []formPart{
+            {field: "pod.yaml", content: testManifest + "---\n" + configMap},
+            {field: "pod.yaml.1", content: configMap},
+        }, ""},
+        {"limit counts across manifests", nil, []formPart{
+            {field: "pod.yaml", content: testManifest + "---\n" + configMap},
+            {field: "pod.yaml.1", content: configMap + "---\n" + configMap},
+        }, "pod.yaml.1: exceeds the limit of 3 documents per upload"},
+        {"empty documents not counted", nil, []formPart{
+            {field: "pod.yaml", content: "---\n" + testManifest + "---\n---\n" + configMap + "---\n" + configMap},
+        }, ""},
+        {"disallowed kind", nil, []formPart{
+            {field: "pod.yaml", content: testManifest},
+            {field: "pod.yaml.1", content: configMap + "---\n" + namespace},
+        }, `pod.yaml.1: document 2: kind "Namespace" is not allowed`},
+        {"any kind without an allowlist", func(cfg *Config) {
+            cfg.AllowedKinds = nil
+        }, []formPart{
+            {field: "pod.yaml", content: testManifest + "---\n" + namespace},
+        }, ""},
+        {"unparsable", nil, []formPart{
+            {field: "pod.yaml", content: "kind: [Pod\n"},
+        }, "pod.yaml: failed to parse manifest"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            ts := newTestServer(t, func(cfg *Config) {
+                cfg.MaxDocuments = 3
+                if tt.configure != nil {
+                    tt.configure(cfg)
+                }
+            })
+            resp := ts.do(multipartRequest(t, "/upload", tt.parts...))
+            if tt.want == "" {
+                require.Equal(t, http.StatusCreated, resp.Code, resp.Body.String())
+                return
+            }
+            require.Equal(t, http.StatusBadRequest, resp.Code, resp.Body.String())
+            var body errorResponse
+            require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &body))
+            assert.Contains(t, body.Error, tt.want)
+            assert.NoFileExists(t, podManifestPath(ts.cfg.ManifestDir, 0))
+            assert.Empty(t, ts.measurer.paths())
+        })
+    }
+}
@@ -0,0 +1,72 @@
+package provisioner
+
+import (
+    "fmt"
+    "log/slog"
+    "os/exec"
+    "strings"
+    "time"
+)
+
+// What `podman healthcheck run` reports for a container without a HEALTHCHECK
+const noHealthcheckMessage = "has no defined healthcheck"
+
+// Poll the healthchecks of the containers of the given pods until all of
+// them pass or timeout elapses. Containers without a healthcheck are
+// skipped, so pods defining none pass right away.
+func waitHealthy(podman string, pods []string, timeout, interval time.Duration) error {
+    var pending []string
+    for _, pod := range pods {
+        containers, err := listContainers(podman, pod)
+        if err != nil {
+            return err
+        }
+        for _, c := range containers {
+            pending = append(pending, c.Name)
+        }
+    }
+
+    deadline := time.Now().Add(timeout)
+    for {
+        var unhealthy, failures []string
+        for _, container := range pending {
+            healthy, defined, output := runHealthcheck(podman, container)
+            if !defined {
+                slog.Debug("Container has no healthcheck", "container", container)
+                continue
+            }
+            if healthy {
+                slog.Info("Container healthy", "container", container)
+                continue
+            }
+            unhealthy = append(unhealthy, container)
+            failures = append(failures, fmt.Sprintf("%s: %s", container, output))
+        }
+        if len(unhealthy) == 0 {
+            return nil
+        }
+        if time.Now().Add(interval).After(deadline) {
+            return fmt.Errorf("containers not healthy after %v: %s", timeout, strings.Join(failures, "; "))
+        }
+        slog.Info("Waiting for containers to become healthy", "containers", unhealthy, "interval", interval)
+        time.Sleep(interval)
+        pending = unhealthy
+    }
+}
+
+// Run a container's healthcheck once. defined is false when the container
+// has no healthcheck at all.
+func runHealthcheck(podman, container string) (healthy, defined bool, output string) {
+    out, err := exec.Command(podman, "healthcheck", "run", container).CombinedOutput()
+    output = strings.TrimSpace(string(out))
+    if err == nil {
+        return true, true, output
+    }
+    if strings.Contains(output, noHealthcheckMessage) {
+        return false, false, output
+    }
+    if output == "" {
+        output = err.Error()
+    }
+    return false, true, output
+}
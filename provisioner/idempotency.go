@@ -0,0 +1,97 @@
+package provisioner
+
+import (
+    "bytes"
+    "net/http"
+    "sync"
+    "time"
+)
+
+// Header making a /start safe to retry: a repeated key gets the response
+// of the first request instead of starting again
+const (
+    idempotencyKeyHeader    = "Idempotency-Key"
+    idempotentReplayHeader  = "Idempotent-Replayed"
+    maxIdempotencyKeyLength = 255
+)
+
+// A response as sent to the first request with a key
+type cachedResponse struct {
+    Status  int       `json:"status"`
+    Body    []byte    `json:"body"`
+    Expires time.Time `json:"expires"`
+}
+
+// Responses by idempotency key, each kept for ttl. They are persisted in
+// the provisioning state: a successful /start shuts the server down, and
+// the retry the key is for may well reach the next one.
+type idempotencyCache struct {
+    mu        sync.Mutex
+    ttl       time.Duration
+    state     *provisioningState
+    responses map[string]cachedResponse
+}
+
+// Cache starting with the responses state kept
+func newIdempotencyCache(ttl time.Duration, state *provisioningState) *idempotencyCache {
+    return &idempotencyCache{ttl: ttl, state: state, responses: state.idempotentResponses()}
+}
+
+// The response cached for key, if it hasn't expired yet. Expired entries
+// are dropped on the way.
+func (c *idempotencyCache) get(key string) (cachedResponse, bool) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    now := time.Now()
+    for k, resp := range c.responses {
+        if now.After(resp.Expires) {
+            delete(c.responses, k)
+        }
+    }
+    resp, ok := c.responses[key]
+    return resp, ok
+}
+
+// Cache the response to key, persisting it before returning
+func (c *idempotencyCache) put(key string, status int, body []byte) error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.responses[key] = cachedResponse{Status: status, Body: body, Expires: time.Now().Add(c.ttl)}
+    return c.state.saveIdempotentResponses(c.responses)
+}
+
+// Send a cached response again, marked as a replay
+func (resp cachedResponse) replay(w http.ResponseWriter) {
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("X-Content-Type-Options", "nosniff")
+    w.Header().Set(idempotentReplayHeader, "true")
+    w.WriteHeader(resp.Status)
+    w.Write(resp.Body)
+}
+
+// ResponseWriter wrapper keeping a copy of the response, for caching it
+type responseCapture struct {
+    http.ResponseWriter
+    status int
+    body   bytes.Buffer
+}
+
+func (c *responseCapture) WriteHeader(code int) {
+    if c.status == 0 {
+        c.status = code
+    }
+    c.ResponseWriter.WriteHeader(code)
+}
+
+func (c *responseCapture) Write(b []byte) (int, error) {
+    if c.status == 0 {
+        c.status = http.StatusOK
+    }
+    c.body.Write(b)
+    return c.ResponseWriter.Write(b)
+}
+
+// Lets http.ResponseController reach Flush and friends of the wrapped writer
+func (c *responseCapture) Unwrap() http.ResponseWriter {
+    return c.ResponseWriter
+}
@@ -0,0 +1,33 @@
+package provisioner
+
+import (
+    "fmt"
+    "io/fs"
+    "net"
+    "os"
+    "syscall"
+)
+
+// Listen on a Unix domain socket only the owner can connect to. A stale
+// socket left by a previous run is removed first, any other kind of file
+// at path is left alone.
+func listenUnix(path string) (net.Listener, error) {
+    if info, err := os.Lstat(path); err == nil {
+        if info.Mode().Type() != fs.ModeSocket {
+            return nil, fmt.Errorf("%s exists and is not a socket", path)
+        }
+        if err := os.Remove(path); err != nil {
+            return nil, fmt.Errorf("failed to remove stale socket: %v", err)
+        }
+    }
+
+    // Create the socket with 0600 right away rather than chmod-ing it
+    // after the fact, when someone could already have connected
+    oldMask := syscall.Umask(0177)
+    ln, err := net.Listen("unix", path)
+    syscall.Umask(oldMask)
+    if err != nil {
+        return nil, err
+    }
+    return ln, nil
+}
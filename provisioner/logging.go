@@ -0,0 +1,50 @@
+package provisioner
+
+import (
+    "log/slog"
+    "net/http"
+    "time"
+)
+
+// ResponseWriter wrapper remembering the status code of the response
+type statusRecorder struct {
+    http.ResponseWriter
+    status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+    if r.status == 0 {
+        r.status = code
+    }
+    r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+    if r.status == 0 {
+        r.status = http.StatusOK
+    }
+    return r.ResponseWriter.Write(b)
+}
+
+// Lets http.ResponseController reach Flush and friends of the wrapped writer
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+    return r.ResponseWriter
+}
+
+// Middleware logging one line per request with its status and duration
+func logRequests(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        started := time.Now()
+        rec := &statusRecorder{ResponseWriter: w}
+        next.ServeHTTP(rec, r)
+        if rec.status == 0 {
+            rec.status = http.StatusOK
+        }
+        slog.Info("Request",
+            "method", r.Method,
+            "path", r.URL.Path,
+            "remote_addr", r.RemoteAddr,
+            "status", rec.status,
+            "duration", time.Since(started))
+    })
+}
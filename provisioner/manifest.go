@@ -0,0 +1,369 @@
+package provisioner
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "io"
+    "mime/multipart"
+    "os"
+    "path/filepath"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+
+    "gopkg.in/yaml.v3"
+)
+
+const podManifestField = "pod.yaml"
+
+// Path of the n-th pod manifest in dir. The primary manifest keeps the
+// historical pod.yaml name, additional ones are stored as pod.<n>.yaml next
+// to it.
+func podManifestPath(dir string, n int) string {
+    if n == 0 {
+        return filepath.Join(dir, "pod.yaml")
+    }
+    return filepath.Join(dir, fmt.Sprintf("pod.%d.yaml", n))
+}
+
+// Matches every additional manifest podManifestPath puts in dir
+func podManifestGlob(dir string) string {
+    return filepath.Join(dir, "pod.*.yaml")
+}
+
+// List the pod manifests stored in dir in measurement order
+func listPodManifests(dir string) []string {
+    var manifests []string
+    for n := 0; fileExists(podManifestPath(dir, n)); n++ {
+        manifests = append(manifests, podManifestPath(dir, n))
+    }
+    return manifests
+}
+
+// Collect the uploaded manifests in their canonical order.
+//
+// The primary manifest is sent as "pod.yaml", additional manifests as
+// "pod.yaml.1", "pod.yaml.2", ... without gaps. The returned slice is ordered
+// by that index, independently of the order of the parts in the request, so
+// the PCR value resulting from measuring them in sequence is reproducible.
+func formManifests(form *multipart.Form) ([]*multipart.FileHeader, error) {
+    byIndex := make(map[int]*multipart.FileHeader)
+    for field, headers := range form.File {
+        if field != podManifestField && !strings.HasPrefix(field, podManifestField+".") {
+            continue
+        }
+        n, err := manifestFieldIndex(field)
+        if err != nil {
+            return nil, err
+        }
+        if len(headers) != 1 {
+            return nil, fmt.Errorf("%s must be sent exactly once", field)
+        }
+        byIndex[n] = headers[0]
+    }
+
+    if _, ok := byIndex[0]; !ok {
+        return nil, fmt.Errorf("%s is required", podManifestField)
+    }
+
+    indices := make([]int, 0, len(byIndex))
+    for n := range byIndex {
+        indices = append(indices, n)
+    }
+    sort.Ints(indices)
+
+    manifests := make([]*multipart.FileHeader, 0, len(indices))
+    for i, n := range indices {
+        if n != i {
+            return nil, fmt.Errorf("%s.%d is missing", podManifestField, i)
+        }
+        manifests = append(manifests, byIndex[n])
+    }
+    return manifests, nil
+}
+
+// Parse the manifest index out of a form field name: "pod.yaml" is 0,
+// "pod.yaml.N" is N. Leading zeros are rejected so every index has a
+// single spelling.
+func manifestFieldIndex(field string) (int, error) {
+    if field == podManifestField {
+        return 0, nil
+    }
+    suffix := strings.TrimPrefix(field, podManifestField+".")
+    n, err := strconv.Atoi(suffix)
+    if err != nil || n < 1 || strconv.Itoa(n) != suffix {
+        return 0, fmt.Errorf("invalid manifest field %q", field)
+    }
+    return n, nil
+}
+
+// Common header of every Kubernetes object in a manifest
+type kubeObject struct {
+    Kind     string `yaml:"kind"`
+    Metadata struct {
+        Name      string `yaml:"name"`
+        Namespace string `yaml:"namespace"`
+    } `yaml:"metadata"`
+}
+
+// Decode the object headers of every document in a manifest
+func parseKubeObjects(data []byte) ([]kubeObject, error) {
+    var objects []kubeObject
+    decoder := yaml.NewDecoder(bytes.NewReader(data))
+    for {
+        var obj kubeObject
+        err := decoder.Decode(&obj)
+        if errors.Is(err, io.EOF) {
+            return objects, nil
+        }
+        if err != nil {
+            return nil, fmt.Errorf("failed to parse manifest: %v", err)
+        }
+        objects = append(objects, obj)
+    }
+}
+
+// Check a manifest's documents against the allowed kinds, counting them on
+// top of the seen documents of earlier manifests and failing once there are
+// more than limit. A nil kinds allows any kind. Returns the new count.
+func checkManifestDocuments(data []byte, seen, limit int, kinds map[string]bool) (int, error) {
+    count := seen
+    decoder := yaml.NewDecoder(bytes.NewReader(data))
+    for {
+        var doc yaml.Node
+        err := decoder.Decode(&doc)
+        if errors.Is(err, io.EOF) {
+            return count, nil
+        }
+        if err != nil {
+            return count, fmt.Errorf("failed to parse manifest: %v", err)
+        }
+        // An empty document between separators decodes to a null scalar
+        if len(doc.Content) == 0 || doc.Content[0].Tag == "!!null" {
+            continue
+        }
+        count++
+        if count > limit {
+            return count, fmt.Errorf("exceeds the limit of %d documents per upload", limit)
+        }
+        if kinds == nil {
+            continue
+        }
+        var obj kubeObject
+        if err := doc.Decode(&obj); err != nil {
+            return count, fmt.Errorf("document %d: %v", count-seen, err)
+        }
+        if !kinds[obj.Kind] {
+            return count, fmt.Errorf("document %d: kind %q is not allowed", count-seen, obj.Kind)
+        }
+    }
+}
+
+// Names of the pods podman creates when playing the manifests stored in
+// dir. A Pod keeps its name, a Deployment gets a "-pod" suffix.
+func podNames(dir string) ([]string, error) {
+    var names []string
+    for _, manifest := range listPodManifests(dir) {
+        data, err := os.ReadFile(manifest)
+        if err != nil {
+            return nil, err
+        }
+        objects, err := parseKubeObjects(data)
+        if err != nil {
+            return nil, fmt.Errorf("%s: %v", manifest, err)
+        }
+        for _, obj := range objects {
+            switch obj.Kind {
+            case "Pod":
+                names = append(names, obj.Metadata.Name)
+            case "Deployment":
+                names = append(names, obj.Metadata.Name+"-pod")
+            }
+        }
+    }
+    return names, nil
+}
+
+// Image references of all containers and init containers in a manifest,
+// deduplicated, in order of appearance. Works for Pods as well as for
+// workloads with a pod template, by looking for container lists anywhere,
+// and for the services of a compose file.
+func manifestImages(data []byte) ([]string, error) {
+    var images []string
+    seen := make(map[string]bool)
+    add := func(container *yaml.Node) {
+        if image := mappingValue(container, "image"); image != "" && !seen[image] {
+            seen[image] = true
+            images = append(images, image)
+        }
+    }
+
+    var walk func(node *yaml.Node)
+    walk = func(node *yaml.Node) {
+        if node.Kind == yaml.MappingNode {
+            for i := 0; i+1 < len(node.Content); i += 2 {
+                key, value := node.Content[i], node.Content[i+1]
+                if (key.Value == "containers" || key.Value == "initContainers") && value.Kind == yaml.SequenceNode {
+                    for _, container := range value.Content {
+                        add(container)
+                    }
+                }
+                if key.Value == "services" && value.Kind == yaml.MappingNode {
+                    for j := 1; j < len(value.Content); j += 2 {
+                        add(value.Content[j])
+                    }
+                }
+            }
+        }
+        for _, child := range node.Content {
+            walk(child)
+        }
+    }
+
+    decoder := yaml.NewDecoder(bytes.NewReader(data))
+    for {
+        var doc yaml.Node
+        err := decoder.Decode(&doc)
+        if errors.Is(err, io.EOF) {
+            return images, nil
+        }
+        if err != nil {
+            return nil, fmt.Errorf("failed to parse manifest: %v", err)
+        }
+        walk(&doc)
+    }
+}
+
+// Images not starting with any of the allowed registry prefixes
+func disallowedImages(images, allowedRegistries []string) []string {
+    var disallowed []string
+    for _, image := range images {
+        allowed := false
+        for _, prefix := range allowedRegistries {
+            if strings.HasPrefix(image, prefix) {
+                allowed = true
+                break
+            }
+        }
+        if !allowed {
+            disallowed = append(disallowed, image)
+        }
+    }
+    return disallowed
+}
+
+// Images referenced by all manifests stored in dir
+func storedManifestImages(dir string) ([]string, error) {
+    var images []string
+    seen := make(map[string]bool)
+    for _, manifest := range listPodManifests(dir) {
+        data, err := os.ReadFile(manifest)
+        if err != nil {
+            return nil, err
+        }
+        found, err := manifestImages(data)
+        if err != nil {
+            return nil, fmt.Errorf("%s: %v", manifest, err)
+        }
+        for _, image := range found {
+            if !seen[image] {
+                seen[image] = true
+                images = append(images, image)
+            }
+        }
+    }
+    return images, nil
+}
+
+// Scalar value of key in a mapping node, empty if absent
+func mappingValue(node *yaml.Node, key string) string {
+    if node.Kind != yaml.MappingNode {
+        return ""
+    }
+    for i := 0; i+1 < len(node.Content); i += 2 {
+        if node.Content[i].Value == key && node.Content[i+1].Kind == yaml.ScalarNode {
+            return node.Content[i+1].Value
+        }
+    }
+    return ""
+}
+
+// Kubernetes object names and namespaces are DNS-1123 labels
+var dns1123Label = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+func validateDNS1123Label(value string) error {
+    if len(value) > 63 || !dns1123Label.MatchString(value) {
+        return fmt.Errorf("%q is not a valid DNS-1123 label", value)
+    }
+    return nil
+}
+
+// Rewrite the metadata of a manifest: the name of its Pods and Deployments
+// when podName is set, and the namespace of every object when namespace is
+// set. Returns the rewritten manifest and the number of renamed objects.
+func rewriteManifestMetadata(data []byte, podName, namespace string) ([]byte, int, error) {
+    var out bytes.Buffer
+    encoder := yaml.NewEncoder(&out)
+    encoder.SetIndent(2)
+
+    renamed := 0
+    decoder := yaml.NewDecoder(bytes.NewReader(data))
+    for {
+        var doc yaml.Node
+        err := decoder.Decode(&doc)
+        if errors.Is(err, io.EOF) {
+            break
+        }
+        if err != nil {
+            return nil, 0, fmt.Errorf("failed to parse manifest: %v", err)
+        }
+        if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+            return nil, 0, errors.New("manifest documents must be objects")
+        }
+
+        root := doc.Content[0]
+        metadata := mappingChild(root, "metadata")
+        if kind := mappingValue(root, "kind"); podName != "" && (kind == "Pod" || kind == "Deployment") {
+            setMappingValue(metadata, "name", podName)
+            renamed++
+        }
+        if namespace != "" {
+            setMappingValue(metadata, "namespace", namespace)
+        }
+
+        if err := encoder.Encode(&doc); err != nil {
+            return nil, 0, fmt.Errorf("failed to encode manifest: %v", err)
+        }
+    }
+    if err := encoder.Close(); err != nil {
+        return nil, 0, fmt.Errorf("failed to encode manifest: %v", err)
+    }
+    return out.Bytes(), renamed, nil
+}
+
+// Mapping value of key in a mapping node, created if absent
+func mappingChild(node *yaml.Node, key string) *yaml.Node {
+    for i := 0; i+1 < len(node.Content); i += 2 {
+        if node.Content[i].Value == key && node.Content[i+1].Kind == yaml.MappingNode {
+            return node.Content[i+1]
+        }
+    }
+    child := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+    node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, child)
+    return child
+}
+
+// Set a string value in a mapping node, replacing any previous value
+func setMappingValue(node *yaml.Node, key, value string) {
+    for i := 0; i+1 < len(node.Content); i += 2 {
+        if node.Content[i].Value == key {
+            node.Content[i+1] = &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
+            return
+        }
+    }
+    node.Content = append(node.Content,
+        &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key},
+        &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value})
+}
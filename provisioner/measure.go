@@ -0,0 +1,198 @@
+package provisioner
+
+import (
+    "crypto"
+    _ "crypto/sha1"
+    _ "crypto/sha256"
+    _ "crypto/sha512"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "log/slog"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+
+    "github.com/google/go-tpm/tpm2"
+    "github.com/google/go-tpm/tpm2/transport"
+)
+
+// PCRs the uploaded files are measured into
+const (
+    podPCR = 13
+    envPCR = 14
+)
+
+// Where measurements are recorded, resolved from the Config by New
+type measurementConfig struct {
+    pcr      bool
+    nv       bool
+    nvIndex  uint32
+    hashName string
+    hashAlg  tpm2.TPMAlgID
+    hash     crypto.Hash
+    // Where PCR measurements go
+    measurer Measurer
+    // nil when no TPM device is configured
+    tpm transport.TPMCloser
+    // PCR extended with the summary of every provisioning phase, 0 if
+    // there is none
+    summaryPCR int
+    // Event log every measurement is appended to
+    eventLog string
+}
+
+// One entry of the event log, telling verifiers what was measured and where
+type measurementEvent struct {
+    Path      string `json:"path"`
+    Digest    string `json:"digest"`
+    Algorithm string `json:"algorithm"`
+    Target    string `json:"target"`
+    PCR       *int   `json:"pcr,omitempty"`
+    NVIndex   string `json:"nv_index,omitempty"`
+    // The summary document the digest is over, for summary measurements
+    Summary string `json:"summary,omitempty"`
+}
+
+// Parse a measurement target: pcr, nv or both
+func parseMeasurementTarget(target string) (pcr, nv bool, err error) {
+    switch target {
+    case "pcr":
+        return true, false, nil
+    case "nv":
+        return false, true, nil
+    case "both":
+        return true, true, nil
+    }
+    return false, false, fmt.Errorf("unknown measurement target %q (want pcr, nv or both)", target)
+}
+
+// A file to measure and the PCR it goes into
+type measuredFile struct {
+    path string
+    pcr  int
+}
+
+// Measure a set of files in canonical order: by PCR, so every manifest is
+// measured before the env, and within a PCR in the order given, which for
+// manifests is their pod.yaml.N index. The multipart field order of the
+// upload therefore never affects the resulting PCR values.
+//
+// On failure the paths measured before it are returned with the error;
+// the file that failed may have been recorded in some targets.
+func (m *measurementConfig) measureFiles(files []measuredFile) (measured []string, err error) {
+    ordered := append([]measuredFile(nil), files...)
+    sort.SliceStable(ordered, func(i, j int) bool {
+        return ordered[i].pcr < ordered[j].pcr
+    })
+    for _, f := range ordered {
+        if err := m.measure(f.path, f.pcr); err != nil {
+            return measured, fmt.Errorf("%s: %v", filepath.Base(f.path), err)
+        }
+        measured = append(measured, f.path)
+    }
+    return measured, nil
+}
+
+// Measure a file into the configured targets: the given PCR, the configured
+// NV index, or both. The file is hashed with the configured algorithm and
+// every measurement is recorded in the event log.
+func (m *measurementConfig) measure(path string, pcrIndex int) error {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return fmt.Errorf("failed to read %s: %v", path, err)
+    }
+    h := m.hash.New()
+    h.Write(data)
+    digest := h.Sum(nil)
+
+    if m.pcr {
+        if err := m.measureIntoPCR(path, pcrIndex, digest); err != nil {
+            return err
+        }
+        if err := m.appendEvent(measurementEvent{Path: path, Digest: hex.EncodeToString(digest), Algorithm: m.hashName, Target: "pcr", PCR: &pcrIndex}); err != nil {
+            return err
+        }
+    }
+
+    if m.nv {
+        slog.Info("Measuring file into NV index", "path", path, "nv_index", fmt.Sprintf("0x%08x", m.nvIndex))
+        if err := nvExtend(m.tpm, m.nvIndex, digest); err != nil {
+            return err
+        }
+        if err := m.appendEvent(measurementEvent{Path: path, Digest: hex.EncodeToString(digest), Algorithm: m.hashName, Target: "nv", NVIndex: fmt.Sprintf("0x%08x", m.nvIndex)}); err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+// Extend a file's digest into a PCR through the configured measurer
+func (m *measurementConfig) measureIntoPCR(filepath string, pcrIndex int, digest []byte) error {
+    slog.Info("Measuring file into PCR", "path", filepath, "pcr", pcrIndex, "algorithm", m.hashName)
+    return m.measurer.Extend(filepath, pcrIndex, digest)
+}
+
+// Version tag heading every summary document, bumped whenever its format
+// changes
+const summaryVersion = "pod-provisioning-summary/v1"
+
+// Extend the summary PCR with a digest over one provisioning phase: the
+// version tag, the phase and the PCR, path and digest of each of its files
+// in measurement order, one per line. The document goes into the event log
+// along with the digest, so verifiers can check one PCR rather than
+// reconstructing the others.
+func (m *measurementConfig) measureSummary(phase string, files []measuredFile) error {
+    if m.summaryPCR == 0 {
+        return nil
+    }
+    ordered := append([]measuredFile(nil), files...)
+    sort.SliceStable(ordered, func(i, j int) bool {
+        return ordered[i].pcr < ordered[j].pcr
+    })
+
+    var doc strings.Builder
+    fmt.Fprintf(&doc, "%s\nphase %s\n", summaryVersion, phase)
+    for _, f := range ordered {
+        data, err := os.ReadFile(f.path)
+        if err != nil {
+            return fmt.Errorf("failed to read %s: %v", f.path, err)
+        }
+        h := m.hash.New()
+        h.Write(data)
+        fmt.Fprintf(&doc, "file %d %s %x\n", f.pcr, f.path, h.Sum(nil))
+    }
+
+    h := m.hash.New()
+    h.Write([]byte(doc.String()))
+    digest := h.Sum(nil)
+    if err := m.measureIntoPCR("summary:"+phase, m.summaryPCR, digest); err != nil {
+        return err
+    }
+    pcr := m.summaryPCR
+    return m.appendEvent(measurementEvent{Path: "summary:" + phase, Digest: hex.EncodeToString(digest), Algorithm: m.hashName, Target: "pcr", PCR: &pcr, Summary: doc.String()})
+}
+
+// Append an entry to the event log, syncing it before returning
+func (m *measurementConfig) appendEvent(event measurementEvent) error {
+    line, err := json.Marshal(event)
+    if err != nil {
+        return fmt.Errorf("failed to encode event: %v", err)
+    }
+
+    f, err := os.OpenFile(m.eventLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+    if err != nil {
+        return fmt.Errorf("failed to open event log: %v", err)
+    }
+    defer f.Close()
+
+    if _, err := f.Write(append(line, '\n')); err != nil {
+        return fmt.Errorf("failed to write event log: %v", err)
+    }
+    if err := f.Sync(); err != nil {
+        return fmt.Errorf("failed to sync event log: %v", err)
+    }
+    return nil
+}
@@ -0,0 +1,110 @@
+package provisioner
+
+import (
+    "bytes"
+    "context"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "io"
+    "log/slog"
+    "net"
+    "net/http"
+    "net/url"
+    "time"
+
+    "github.com/google/go-tpm/tpm2"
+    "github.com/google/go-tpm/tpm2/transport"
+)
+
+// Backend PCR measurements are extended into. The digest is over the file
+// at path, hashed with the configured PCR hash; NV measurements always go
+// to the TPM.
+type Measurer interface {
+    Extend(path string, index int, digest []byte) error
+}
+
+// Measurer extending the PCRs of a TPM
+type TPMMeasurer struct {
+    tpm      transport.TPM
+    hashName string
+    alg      tpm2.TPMAlgID
+    // PCRs allocated in the alg bank, read once at startup
+    bank []byte
+}
+
+func NewTPMMeasurer(tpm transport.TPM, hashName string, alg tpm2.TPMAlgID, bank []byte) *TPMMeasurer {
+    return &TPMMeasurer{tpm: tpm, hashName: hashName, alg: alg, bank: bank}
+}
+
+func (t *TPMMeasurer) Extend(path string, index int, digest []byte) error {
+    if !pcrSelected(t.bank, index) {
+        return fmt.Errorf("PCR %d is not allocated in the %s bank", index, t.hashName)
+    }
+    return pcrExtend(t.tpm, index, t.alg, digest)
+}
+
+// Timeout of a request to the attestation agent
+const agentTimeout = 10 * time.Second
+
+// Measurer handing measurements to an external attestation agent, which
+// gets each one POSTed as JSON and has to answer with a 2xx
+type AgentMeasurer struct {
+    url       string
+    algorithm string
+    client    *http.Client
+}
+
+// Body of a request to the attestation agent
+type agentMeasurement struct {
+    Path      string `json:"path"`
+    PCR       int    `json:"pcr"`
+    Algorithm string `json:"algorithm"`
+    Digest    string `json:"digest"`
+}
+
+// Agent measurer POSTing to agentURL, an http:// or https:// URL. With a
+// socket the requests go over that Unix socket instead, agentURL only
+// supplying the path.
+func NewAgentMeasurer(agentURL, socket, algorithm string) (*AgentMeasurer, error) {
+    u, err := url.Parse(agentURL)
+    if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+        return nil, fmt.Errorf("invalid agent URL %q, want http:// or https://", agentURL)
+    }
+    client := &http.Client{Timeout: agentTimeout}
+    if socket != "" {
+        var dialer net.Dialer
+        client.Transport = &http.Transport{
+            DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+                return dialer.DialContext(ctx, "unix", socket)
+            },
+        }
+    }
+    return &AgentMeasurer{url: agentURL, algorithm: algorithm, client: client}, nil
+}
+
+func (a *AgentMeasurer) Extend(path string, index int, digest []byte) error {
+    body, err := json.Marshal(agentMeasurement{Path: path, PCR: index, Algorithm: a.algorithm, Digest: hex.EncodeToString(digest)})
+    if err != nil {
+        return fmt.Errorf("failed to encode measurement: %v", err)
+    }
+    resp, err := a.client.Post(a.url, "application/json", bytes.NewReader(body))
+    if err != nil {
+        return fmt.Errorf("failed to send measurement to agent: %v", err)
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode < 200 || resp.StatusCode > 299 {
+        msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+        return fmt.Errorf("agent rejected measurement of PCR %d: %s: %s", index, resp.Status, bytes.TrimSpace(msg))
+    }
+    return nil
+}
+
+// Measurer recording nothing, measurements only show up in the log and
+// the event log. For testing without a TPM.
+type NoopMeasurer struct{}
+
+func (NoopMeasurer) Extend(path string, index int, digest []byte) error {
+    slog.Debug("No measurer, not extending", "path", path, "pcr", index)
+    return nil
+}
@@ -0,0 +1,39 @@
+package provisioner
+
+import (
+    "fmt"
+    "log/slog"
+    "net"
+    "os"
+    "strings"
+)
+
+// Send a state update like READY=1 to systemd (sd_notify). Does nothing
+// unless the service manager set NOTIFY_SOCKET, i.e. for Type=notify units.
+func sdNotify(state string) error {
+    socket := os.Getenv("NOTIFY_SOCKET")
+    if socket == "" {
+        return nil
+    }
+    // A leading @ names a socket in the abstract namespace
+    if strings.HasPrefix(socket, "@") {
+        socket = "\x00" + socket[1:]
+    }
+
+    conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+    if err != nil {
+        return fmt.Errorf("failed to connect to notify socket: %v", err)
+    }
+    defer conn.Close()
+    if _, err := conn.Write([]byte(state)); err != nil {
+        return fmt.Errorf("failed to send notification: %v", err)
+    }
+    return nil
+}
+
+// sdNotify, logging failures instead of returning them
+func notifySystemd(state string) {
+    if err := sdNotify(state); err != nil {
+        slog.Warn("Failed to notify systemd", "state", state, "error", err)
+    }
+}
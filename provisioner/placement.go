@@ -0,0 +1,70 @@
+package provisioner
+
+import (
+    "fmt"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strconv"
+    "syscall"
+)
+
+// Where the runtime command starting a pod is placed, so a misbehaving
+// workload is throttled or OOM-killed before the provisioner itself. The
+// zero value leaves the command in the provisioner's cgroup and OOM score.
+type startPlacement struct {
+    // cgroup v2 directory the command is created in
+    cgroup string
+    // oom_score_adj of the command, nil to inherit the provisioner's
+    oomScoreAdj *int
+}
+
+// Validate the placement settings before any pod is started
+func newStartPlacement(cgroup string, oomScoreAdj *int) (startPlacement, error) {
+    if cgroup != "" {
+        if _, err := os.Stat(filepath.Join(cgroup, "cgroup.procs")); err != nil {
+            return startPlacement{}, fmt.Errorf("invalid start cgroup %s, not a cgroup v2 directory: %v", cgroup, err)
+        }
+    }
+    if oomScoreAdj != nil && (*oomScoreAdj < -1000 || *oomScoreAdj > 1000) {
+        return startPlacement{}, fmt.Errorf("invalid start OOM score adjustment %d (want -1000 to 1000)", *oomScoreAdj)
+    }
+    return startPlacement{cgroup: cgroup, oomScoreAdj: oomScoreAdj}, nil
+}
+
+// Have cmd created directly in the cgroup, so none of its children can fork
+// before being moved there. The returned function closes the cgroup
+// directory once cmd has been started.
+func (p startPlacement) prepare(cmd *exec.Cmd) (func(), error) {
+    if p.cgroup == "" {
+        return func() {}, nil
+    }
+    dir, err := os.Open(p.cgroup)
+    if err != nil {
+        return nil, fmt.Errorf("failed to open start cgroup: %v", err)
+    }
+    cmd.SysProcAttr.UseCgroupFD = true
+    cmd.SysProcAttr.CgroupFD = int(dir.Fd())
+    return func() { dir.Close() }, nil
+}
+
+// Adjust the OOM score of the started command. There's no way to have it
+// set by the clone, so it's written right after and inherited by whatever
+// the command forks from then on.
+func (p startPlacement) applyStarted(pid int) error {
+    if p.oomScoreAdj == nil {
+        return nil
+    }
+    path := fmt.Sprintf("/proc/%d/oom_score_adj", pid)
+    if err := os.WriteFile(path, []byte(strconv.Itoa(*p.oomScoreAdj)), 0); err != nil {
+        return fmt.Errorf("failed to set OOM score adjustment: %v", err)
+    }
+    return nil
+}
+
+// Kill a started command whose placement couldn't be applied, along with
+// its process group
+func killStarted(cmd *exec.Cmd) {
+    syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+    cmd.Wait()
+}
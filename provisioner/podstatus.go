@@ -0,0 +1,153 @@
+package provisioner
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "os/exec"
+    "strings"
+)
+
+// Status of one pod and its containers
+type podStatus struct {
+    ID         string            `json:"id,omitempty"`
+    Name       string            `json:"name"`
+    State      string            `json:"state"`
+    Error      string            `json:"error,omitempty"`
+    Containers []containerStatus `json:"containers"`
+}
+
+type containerStatus struct {
+    ID    string `json:"id,omitempty"`
+    Name  string `json:"name"`
+    State string `json:"state"`
+}
+
+// Body of a /ready response
+type readyResponse struct {
+    Ready bool        `json:"ready"`
+    Pods  []podStatus `json:"pods"`
+}
+
+// The fields of `podman pod inspect` output we care about
+type podInspect struct {
+    ID         string `json:"Id"`
+    Name       string `json:"Name"`
+    State      string `json:"State"`
+    Containers []struct {
+        ID    string `json:"Id"`
+        Name  string `json:"Name"`
+        State string `json:"State"`
+    } `json:"Containers"`
+}
+
+// Query podman for the state of a pod and its containers. Failures are
+// reported in the Error field, a pod that can't be inspected isn't ready.
+func inspectPod(podman, name string) podStatus {
+    status := podStatus{Name: name, State: "unknown", Containers: []containerStatus{}}
+
+    out, err := exec.Command(podman, "pod", "inspect", name).Output()
+    if err != nil {
+        var exitErr *exec.ExitError
+        if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+            status.Error = strings.TrimSpace(string(exitErr.Stderr))
+        } else {
+            status.Error = err.Error()
+        }
+        return status
+    }
+
+    // podman 4 prints a single object, podman 5 an array of them
+    var pods []podInspect
+    if err := json.Unmarshal(out, &pods); err != nil {
+        var pod podInspect
+        if err := json.Unmarshal(out, &pod); err != nil {
+            status.Error = "failed to parse podman output: " + err.Error()
+            return status
+        }
+        pods = []podInspect{pod}
+    }
+    if len(pods) != 1 {
+        status.Error = "unexpected podman output"
+        return status
+    }
+
+    status.ID = pods[0].ID
+    status.State = pods[0].State
+    for _, c := range pods[0].Containers {
+        status.Containers = append(status.Containers, containerStatus{ID: c.ID, Name: c.Name, State: c.State})
+    }
+    return status
+}
+
+// A pod is ready when it has containers and all of them are running
+func (s podStatus) ready() bool {
+    if s.Error != "" || len(s.Containers) == 0 {
+        return false
+    }
+    for _, c := range s.Containers {
+        if !strings.EqualFold(c.State, "running") {
+            return false
+        }
+    }
+    return true
+}
+
+// A running container as listed by /containers
+type containerInfo struct {
+    Name   string     `json:"name"`
+    Image  string     `json:"image"`
+    Status string     `json:"status"`
+    Ports  []portInfo `json:"ports"`
+}
+
+type portInfo struct {
+    HostIP        string `json:"host_ip,omitempty"`
+    HostPort      int    `json:"host_port"`
+    ContainerPort int    `json:"container_port"`
+    Protocol      string `json:"protocol"`
+}
+
+// The fields of `podman ps --format json` output we care about
+type psEntry struct {
+    Names  []string `json:"Names"`
+    Image  string   `json:"Image"`
+    Status string   `json:"Status"`
+    Ports  []struct {
+        HostIP        string `json:"host_ip"`
+        ContainerPort int    `json:"container_port"`
+        HostPort      int    `json:"host_port"`
+        Range         int    `json:"range"`
+        Protocol      string `json:"protocol"`
+    } `json:"Ports"`
+}
+
+// List the running containers of a pod
+func listContainers(podman, pod string) ([]containerInfo, error) {
+    out, err := exec.Command(podman, "ps", "--format", "json", "--filter", "pod="+pod).Output()
+    if err != nil {
+        var exitErr *exec.ExitError
+        if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+            return nil, fmt.Errorf("podman ps failed: %s", strings.TrimSpace(string(exitErr.Stderr)))
+        }
+        return nil, fmt.Errorf("podman ps failed: %v", err)
+    }
+
+    var entries []psEntry
+    if err := json.Unmarshal(out, &entries); err != nil {
+        return nil, fmt.Errorf("failed to parse podman output: %v", err)
+    }
+
+    containers := make([]containerInfo, 0, len(entries))
+    for _, e := range entries {
+        c := containerInfo{Image: e.Image, Status: e.Status, Ports: []portInfo{}}
+        if len(e.Names) > 0 {
+            c.Name = e.Names[0]
+        }
+        for _, p := range e.Ports {
+            c.Ports = append(c.Ports, portInfo{HostIP: p.HostIP, HostPort: p.HostPort, ContainerPort: p.ContainerPort, Protocol: p.Protocol})
+        }
+        containers = append(containers, c)
+    }
+    return containers, nil
+}
@@ -0,0 +1,50 @@
+package provisioner
+
+import (
+    "math"
+    "net/http"
+    "strconv"
+    "strings"
+
+    "golang.org/x/time/rate"
+)
+
+// Endpoints that hit the TPM or the container runtime, and are rate limited
+var rateLimitedPaths = map[string]bool{
+    "/upload":   true,
+    "/env":      true,
+    "/start":    true,
+    "/restart":  true,
+    "/pull":     true,
+    "/measure":  true,
+    "/validate": true,
+}
+
+// Whether a request to path is rate limited. Committing a resumable upload
+// measures it like /upload; sending its chunks doesn't hit anything.
+func isRateLimited(path string) bool {
+    if rateLimitedPaths[path] {
+        return true
+    }
+    rest, ok := strings.CutPrefix(path, resumablePrefix)
+    return ok && strings.HasSuffix(rest, "/commit")
+}
+
+// Middleware applying one token bucket to all rate limited endpoints.
+// Requests over the limit get a 429 telling them when to retry.
+func rateLimit(limiter *rate.Limiter, next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if !isRateLimited(r.URL.Path) || r.Method == http.MethodOptions {
+            next.ServeHTTP(w, r)
+            return
+        }
+        reservation := limiter.Reserve()
+        if delay := reservation.Delay(); delay > 0 {
+            reservation.Cancel()
+            w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+            writeError(w, "Too many requests", http.StatusTooManyRequests)
+            return
+        }
+        next.ServeHTTP(w, r)
+    })
+}
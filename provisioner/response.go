@@ -0,0 +1,130 @@
+package provisioner
+
+import (
+    "encoding/json"
+    "fmt"
+    "log/slog"
+    "net/http"
+    "time"
+)
+
+// Body of every error response
+type errorResponse struct {
+    Error string `json:"error"`
+    Code  int    `json:"code"`
+}
+
+// Body of a 409 from /upload, naming every file that already exists
+type conflictResponse struct {
+    Error     string   `json:"error"`
+    Code      int      `json:"code"`
+    Conflicts []string `json:"conflicts"`
+}
+
+// Body of an /upload or /measure that failed to store or measure its
+// files. Stage tells which: "write" or "measure". Either way the files are
+// gone again; Measured lists those extended into a PCR before a measurement
+// failed, as those extensions can't be undone.
+type storeErrorResponse struct {
+    Error    string   `json:"error"`
+    Code     int      `json:"code"`
+    Stage    string   `json:"stage"`
+    Measured []string `json:"measured,omitempty"`
+}
+
+// Body of a successful /upload
+type uploadResponse struct {
+    Files []string `json:"files"`
+}
+
+// Body of a failed /start, the reason telling automation what went wrong:
+// image_pull, port_conflict, manifest_invalid, insufficient_resources or
+// unknown
+type startErrorResponse struct {
+    Error  string `json:"error"`
+    Code   int    `json:"code"`
+    Reason string `json:"reason"`
+}
+
+// Body of a successful /start or /restart
+type startResponse struct {
+    Status    string   `json:"status"`
+    Manifests []string   `json:"manifests"`
+    Commands  [][]string `json:"commands,omitempty"`
+    // The started pods with their IDs, podman only
+    Pods []podStatus `json:"pods,omitempty"`
+}
+
+// Body of a successful /pull
+type pullResponse struct {
+    Status string   `json:"status"`
+    Images []string `json:"images"`
+}
+
+// Body of a /healthz response
+type healthResponse struct {
+    Status string `json:"status"`
+}
+
+// Body of a /status response
+type statusResponse struct {
+    Uploaded  bool         `json:"uploaded"`
+    Started   bool         `json:"started"`
+    StartedAt *time.Time   `json:"started_at,omitempty"`
+    Files     []fileStatus `json:"files"`
+}
+
+// A provisioned file as reported by /status. SHA256 is left out for the
+// secrets file, whose content is nobody's business.
+type fileStatus struct {
+    Path        string    `json:"path"`
+    ContentType string    `json:"content_type"`
+    Size        int64     `json:"size"`
+    SHA256      string    `json:"sha256,omitempty"`
+    ModTime     time.Time `json:"mod_time"`
+    PCR         int       `json:"pcr"`
+}
+
+// Body of a /version response
+type versionResponse struct {
+    Version       string `json:"version"`
+    GitCommit     string `json:"git_commit"`
+    BuildDate     string `json:"build_date"`
+    PodmanVersion string `json:"podman_version,omitempty"`
+    // Subcommand manifests are played with: kube play or play kube
+    PodmanPlay string `json:"podman_play,omitempty"`
+}
+
+// Lift the server's WriteTimeout for a response that legitimately takes
+// long, a stream or a request waiting on the container runtime
+func disableWriteTimeout(w http.ResponseWriter) {
+    if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+        slog.Debug("Failed to lift write timeout", "error", err)
+    }
+}
+
+// Write v as a JSON response with the given status code
+func writeJSON(w http.ResponseWriter, code int, v any) {
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("X-Content-Type-Options", "nosniff")
+    w.WriteHeader(code)
+    if err := json.NewEncoder(w).Encode(v); err != nil {
+        slog.Warn("Failed to write response", "error", err)
+    }
+}
+
+// Answer a failure to store or measure files. A failed write is ours, a
+// failed measurement means the TPM or agent is unavailable for now.
+func writeStoreError(w http.ResponseWriter, stage string, err error, measured []string) {
+    resp := storeErrorResponse{Error: fmt.Sprintf("Failed to write %v", err), Code: http.StatusInternalServerError, Stage: stage, Measured: measured}
+    if stage == "measure" {
+        resp.Error = fmt.Sprintf("Failed to measure %v", err)
+        resp.Code = http.StatusServiceUnavailable
+    }
+    writeJSON(w, resp.Code, resp)
+}
+
+// JSON replacement for http.Error
+func writeError(w http.ResponseWriter, message string, code int) {
+    writeJSON(w, code, errorResponse{Error: message, Code: code})
+}
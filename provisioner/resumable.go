@@ -0,0 +1,274 @@
+package provisioner
+
+import (
+    "bytes"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "io"
+    "log/slog"
+    "net/http"
+    "regexp"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Resumable uploads of a pod manifest too large to send reliably in one
+// request over a flaky link:
+//
+//    POST   /upload/init?size=N&sha256=HEX  start an upload, returns its id
+//    PUT    /upload/<id>?offset=N           send bytes N.. with Content-Range
+//    GET    /upload/<id>                    how much arrived, for resuming
+//    POST   /upload/<id>/commit             verify and store it like /upload
+//    DELETE /upload/<id>                    discard it
+//
+// Uploads are held in memory, each at most MaxUploadBytes, and discarded
+// once they have been inactive for ResumableUploadTTL.
+const (
+    resumablePrefix     = "/upload/"
+    maxResumableUploads = 4
+)
+
+// An upload in progress
+type resumableUpload struct {
+    mu      sync.Mutex
+    id      string
+    size    int64
+    sha256  []byte
+    data    []byte
+    expires time.Time
+}
+
+// Uploads in progress by id
+type resumableUploads struct {
+    mu      sync.Mutex
+    ttl     time.Duration
+    uploads map[string]*resumableUpload
+}
+
+func newResumableUploads(ttl time.Duration) *resumableUploads {
+    return &resumableUploads{ttl: ttl, uploads: make(map[string]*resumableUpload)}
+}
+
+// Drop the uploads nobody touched within the TTL. Called with mu held.
+func (u *resumableUploads) expire() {
+    now := time.Now()
+    for id, upload := range u.uploads {
+        if now.After(upload.expires) {
+            slog.Info("Discarding expired resumable upload", "id", id, "received", len(upload.data), "size", upload.size)
+            delete(u.uploads, id)
+        }
+    }
+}
+
+var errTooManyUploads = errors.New("too many resumable uploads in progress")
+
+func (u *resumableUploads) create(size int64, digest []byte) (*resumableUpload, error) {
+    u.mu.Lock()
+    defer u.mu.Unlock()
+    u.expire()
+    if len(u.uploads) >= maxResumableUploads {
+        return nil, errTooManyUploads
+    }
+    id := make([]byte, 16)
+    if _, err := rand.Read(id); err != nil {
+        return nil, fmt.Errorf("failed to generate upload id: %v", err)
+    }
+    upload := &resumableUpload{
+        id:      hex.EncodeToString(id),
+        size:    size,
+        sha256:  digest,
+        data:    make([]byte, 0, size),
+        expires: time.Now().Add(u.ttl),
+    }
+    u.uploads[upload.id] = upload
+    return upload, nil
+}
+
+// The upload with the given id, its expiry pushed back as it's in use
+func (u *resumableUploads) get(id string) (*resumableUpload, bool) {
+    u.mu.Lock()
+    defer u.mu.Unlock()
+    u.expire()
+    upload, ok := u.uploads[id]
+    if ok {
+        upload.expires = time.Now().Add(u.ttl)
+    }
+    return upload, ok
+}
+
+func (u *resumableUploads) remove(id string) {
+    u.mu.Lock()
+    defer u.mu.Unlock()
+    delete(u.uploads, id)
+}
+
+// Body of every successful resumable upload response but the commit
+type resumableResponse struct {
+    ID        string    `json:"id"`
+    Size      int64     `json:"size"`
+    Offset    int64     `json:"offset"`
+    ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (upload *resumableUpload) response() resumableResponse {
+    return resumableResponse{ID: upload.id, Size: upload.size, Offset: int64(len(upload.data)), ExpiresAt: upload.expires.UTC()}
+}
+
+// Dispatch the requests below /upload/
+func (s *Server) handleResumable(w http.ResponseWriter, r *http.Request) {
+    rest := strings.TrimPrefix(r.URL.Path, resumablePrefix)
+    if rest == "init" {
+        if r.Method != http.MethodPost {
+            writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+            return
+        }
+        s.initResumable(w, r)
+        return
+    }
+
+    id, action, _ := strings.Cut(rest, "/")
+    upload, ok := s.resumable.get(id)
+    if !ok {
+        writeError(w, "Unknown or expired upload", http.StatusNotFound)
+        return
+    }
+    switch {
+    case action == "" && r.Method == http.MethodPut:
+        s.putResumable(w, r, upload)
+    case action == "" && r.Method == http.MethodGet:
+        upload.mu.Lock()
+        defer upload.mu.Unlock()
+        writeJSON(w, http.StatusOK, upload.response())
+    case action == "" && r.Method == http.MethodDelete:
+        s.resumable.remove(id)
+        slog.Info("Resumable upload discarded", "id", id)
+        w.WriteHeader(http.StatusNoContent)
+    case action == "commit" && r.Method == http.MethodPost:
+        s.commitResumable(w, r, upload)
+    case action == "" || action == "commit":
+        writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+    default:
+        writeError(w, "Not found", http.StatusNotFound)
+    }
+}
+
+// Start an upload of size bytes hashing to the given SHA-256
+func (s *Server) initResumable(w http.ResponseWriter, r *http.Request) {
+    r.Body = http.MaxBytesReader(w, r.Body, 1<<20)
+    size, err := strconv.ParseInt(r.FormValue("size"), 10, 64)
+    if err != nil || size <= 0 {
+        writeError(w, fmt.Sprintf("Invalid size %q", r.FormValue("size")), http.StatusBadRequest)
+        return
+    }
+    if size > s.cfg.MaxUploadBytes {
+        writeError(w, fmt.Sprintf("Upload exceeds the maximum size of %d bytes", s.cfg.MaxUploadBytes), http.StatusRequestEntityTooLarge)
+        return
+    }
+    digest, err := hex.DecodeString(r.FormValue("sha256"))
+    if err != nil || len(digest) != sha256.Size {
+        writeError(w, fmt.Sprintf("Invalid sha256 %q", r.FormValue("sha256")), http.StatusBadRequest)
+        return
+    }
+
+    // No point in sending a manifest that can't be stored
+    if fileExists(podManifestPath(s.cfg.ManifestDir, 0)) {
+        writeError(w, "pod.yaml already exists", http.StatusConflict)
+        return
+    }
+
+    upload, err := s.resumable.create(size, digest)
+    if errors.Is(err, errTooManyUploads) {
+        writeError(w, err.Error(), http.StatusTooManyRequests)
+        return
+    } else if err != nil {
+        writeError(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    slog.Info("Resumable upload started", "id", upload.id, "size", size)
+    writeJSON(w, http.StatusCreated, upload.response())
+}
+
+// Content-Range of a chunk: bytes first-last/total
+var contentRangePattern = regexp.MustCompile(`^bytes (\d+)-(\d+)/(\d+)$`)
+
+// Append a chunk. It has to start where the received data ends, so a
+// chunk that went missing is noticed; the 409 tells the client where to
+// resume.
+func (s *Server) putResumable(w http.ResponseWriter, r *http.Request, upload *resumableUpload) {
+    upload.mu.Lock()
+    defer upload.mu.Unlock()
+
+    offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+    if err != nil {
+        writeError(w, fmt.Sprintf("Invalid offset %q", r.URL.Query().Get("offset")), http.StatusBadRequest)
+        return
+    }
+    match := contentRangePattern.FindStringSubmatch(r.Header.Get("Content-Range"))
+    if match == nil {
+        writeError(w, "Content-Range must be bytes first-last/total", http.StatusBadRequest)
+        return
+    }
+    first, _ := strconv.ParseInt(match[1], 10, 64)
+    last, _ := strconv.ParseInt(match[2], 10, 64)
+    total, _ := strconv.ParseInt(match[3], 10, 64)
+    if first != offset || last < first || last >= upload.size || total != upload.size {
+        writeError(w, fmt.Sprintf("Content-Range %s doesn't match offset %d of an upload of %d bytes", match[0], offset, upload.size), http.StatusRequestedRangeNotSatisfiable)
+        return
+    }
+    if received := int64(len(upload.data)); offset != received {
+        writeJSON(w, http.StatusConflict, upload.response())
+        return
+    }
+
+    // Read exactly the announced range, not committing anything unless it
+    // arrived in full
+    length := last - first + 1
+    chunk, err := io.ReadAll(io.LimitReader(r.Body, length+1))
+    if err != nil {
+        writeError(w, fmt.Sprintf("Failed to read chunk: %v", err), http.StatusBadRequest)
+        return
+    }
+    if int64(len(chunk)) != length {
+        writeError(w, fmt.Sprintf("Chunk has %d bytes, Content-Range announced %d", len(chunk), length), http.StatusBadRequest)
+        return
+    }
+    upload.data = append(upload.data, chunk...)
+    writeJSON(w, http.StatusOK, upload.response())
+}
+
+// Verify a complete upload and store it as pod.yaml, with the env,
+// secrets and options the commit request may carry just like /upload
+func (s *Server) commitResumable(w http.ResponseWriter, r *http.Request, upload *resumableUpload) {
+    upload.mu.Lock()
+    defer upload.mu.Unlock()
+
+    if received := int64(len(upload.data)); received != upload.size {
+        writeError(w, fmt.Sprintf("Upload incomplete, %d of %d bytes received", received, upload.size), http.StatusConflict)
+        return
+    }
+    if digest := sha256.Sum256(upload.data); !bytes.Equal(digest[:], upload.sha256) {
+        // Something got corrupted on the way, it has to be sent again
+        s.resumable.remove(upload.id)
+        writeError(w, fmt.Sprintf("SHA-256 mismatch, got %x", digest), http.StatusUnprocessableEntity)
+        return
+    }
+
+    if !parseMultipart(w, r, s.cfg.MaxUploadBytes) {
+        return
+    }
+
+    if !s.checkUploadConflicts(w, r.MultipartForm, 1) {
+        return
+    }
+    // Kept until stored, so a commit failing on a measurement that is
+    // unavailable for now can be retried without sending it again
+    if s.finishUpload(w, r, [][]byte{upload.data}, []string{"upload " + upload.id}) {
+        s.resumable.remove(upload.id)
+        slog.Info("Resumable upload committed", "id", upload.id, "size", upload.size)
+    }
+}
@@ -0,0 +1,469 @@
+package provisioner
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "fmt"
+    "log/slog"
+    "os"
+    "os/exec"
+    "strings"
+    "sync"
+    "syscall"
+    "time"
+)
+
+// Container runtime the uploaded manifests are started with. The upload and
+// measurement path is the same whichever runtime is selected.
+type Runtime interface {
+    // Command returns the argv Start runs for a manifest
+    Command(manifest string, replace bool, args []string) []string
+    // Start runs one manifest with env appended to the environment. With
+    // replace, whatever an earlier start of it created is recreated. args
+    // are extra flags for the start command, already validated.
+    Start(manifest string, env []string, replace bool, args []string) error
+    // Stop tears down everything started so far, most recent first
+    Stop() error
+    // Adopt takes manifests an earlier process started as started, for
+    // Stop to tear down, unless this process started any itself
+    Adopt(manifests []string)
+    // Validate checks a manifest against the runtime without starting it
+    Validate(manifest string) error
+    // Pull fetches an image ahead of Start, authenticating with creds if set
+    Pull(image string, creds *RegistryCredentials) error
+}
+
+// Registry credentials for pulling private images. They are only ever held
+// in memory and on tmpfs for the duration of a pull, never written to disk
+// or logged.
+type RegistryCredentials struct {
+    Username string
+    Password string
+}
+
+// Failure of a runtime command, carrying its captured output
+type commandError struct {
+    Stdout string
+    Stderr string
+    Err    error
+}
+
+func (e *commandError) Error() string {
+    return fmt.Sprintf("Stdout: %s\nStderr: %s\nError: %v", e.Stdout, e.Stderr, e.Err)
+}
+
+func (e *commandError) Unwrap() error {
+    return e.Err
+}
+
+// Runtime commands still running, by process group. A runtime runs all its
+// commands through one, New hands the Server's to its runtime.
+type runningCommands struct {
+    mu   sync.Mutex
+    done map[int]chan struct{}
+}
+
+func newRunningCommands() *runningCommands {
+    return &runningCommands{done: make(map[int]chan struct{})}
+}
+
+// Wait until every runtime command running has been reaped, giving up
+// after timeout. Shutdown uses this so the process doesn't exit with a
+// runtime command half way, its process group cut off from its parent.
+func (c *runningCommands) wait(timeout time.Duration) {
+    c.mu.Lock()
+    pending := make(map[int]chan struct{}, len(c.done))
+    for pgid, done := range c.done {
+        pending[pgid] = done
+    }
+    c.mu.Unlock()
+    if len(pending) == 0 {
+        return
+    }
+
+    slog.Info("Waiting for runtime commands to finish", "count", len(pending), "timeout", timeout)
+    deadline := time.Now().Add(timeout)
+    for pgid, done := range pending {
+        select {
+        case <-done:
+        case <-time.After(time.Until(deadline)):
+            slog.Error("Runtime command still running at shutdown", "pgid", pgid)
+        }
+    }
+}
+
+// Run a runtime command to completion, returning a *commandError on failure
+func (c *runningCommands) run(argv []string, env []string) error {
+    return c.runPlaced(argv, env, startPlacement{})
+}
+
+// Run a runtime command like run, placing it as configured first
+func (c *runningCommands) runPlaced(argv []string, env []string, placement startPlacement) error {
+    cmd := exec.Command(argv[0], argv[1:]...)
+    if env != nil {
+        cmd.Env = append(os.Environ(), env...)
+    }
+
+    // Create buffers for output
+    var stdout, stderr bytes.Buffer
+    cmd.Stdout = &stdout
+    cmd.Stderr = &stderr
+
+    // Set process group ID to ensure child processes survive
+    cmd.SysProcAttr = &syscall.SysProcAttr{
+        Setpgid: true,
+    }
+
+    closeCgroup, err := placement.prepare(cmd)
+    if err != nil {
+        return err
+    }
+    err = cmd.Start()
+    closeCgroup()
+    if err != nil {
+        return &commandError{Stdout: stdout.String(), Stderr: stderr.String(), Err: err}
+    }
+    pgid := cmd.Process.Pid
+    done := make(chan struct{})
+    c.mu.Lock()
+    c.done[pgid] = done
+    c.mu.Unlock()
+    defer func() {
+        c.mu.Lock()
+        delete(c.done, pgid)
+        c.mu.Unlock()
+        close(done)
+    }()
+
+    if err := placement.applyStarted(cmd.Process.Pid); err != nil {
+        killStarted(cmd)
+        return err
+    }
+
+    // Wait for completion. Helpers the command left in its process group
+    // are reparented, not our children to reap, but worth knowing about.
+    err = cmd.Wait()
+    if syscall.Kill(-pgid, 0) == nil {
+        slog.Debug("Runtime command left processes running in its group", "argv", argv, "pgid", pgid)
+    }
+    if err != nil {
+        return &commandError{Stdout: stdout.String(), Stderr: stderr.String(), Err: err}
+    }
+    slog.Info("Runtime command succeeded", "argv", argv, "stdout", stdout.String())
+    return nil
+}
+
+// Image references are passed as arguments, make sure they can't pose as flags
+func validateImageRef(image string) error {
+    if image == "" || strings.HasPrefix(image, "-") {
+        return fmt.Errorf("invalid image reference %q", image)
+    }
+    return nil
+}
+
+// Runtime output showing the manifest itself is broken, which no retry
+// will fix. Anything else, like a failed image pull, is worth retrying.
+var fatalStartPatterns = []string{
+    "yaml:",
+    "unmarshal",
+    "invalid",
+    "unknown field",
+    "unsupported kind",
+    "no such file or directory",
+}
+
+// Whether a failed start may succeed when tried again
+func isRetryableStartError(err error) bool {
+    var cmdErr *commandError
+    if !errors.As(err, &cmdErr) {
+        return false
+    }
+    output := strings.ToLower(cmdErr.Stdout + cmdErr.Stderr)
+    for _, pattern := range fatalStartPatterns {
+        if strings.Contains(output, pattern) {
+            return false
+        }
+    }
+    return true
+}
+
+// Why a start failed, as reported in the reason field of the /start error
+const (
+    reasonImagePull             = "image_pull"
+    reasonPortConflict          = "port_conflict"
+    reasonManifestInvalid       = "manifest_invalid"
+    reasonInsufficientResources = "insufficient_resources"
+    reasonUnknown               = "unknown"
+)
+
+// Runtime output patterns of the common start failures. They are checked
+// in order, so the image patterns take precedence over the generic
+// "invalid" of a broken manifest.
+var startFailureReasons = []struct {
+    reason   string
+    patterns []string
+}{
+    {reasonPortConflict, []string{"address already in use", "port is already allocated"}},
+    {reasonInsufficientResources, []string{"no space left on device", "cannot allocate memory", "out of memory", "too many open files", "insufficient"}},
+    {reasonImagePull, []string{"pulling image", "pull access denied", "initializing source", "manifest unknown", "image not known", "requested access to the resource is denied"}},
+    {reasonManifestInvalid, fatalStartPatterns},
+}
+
+// Classify a failed start by the output of its last attempt
+func startFailureReason(err error) string {
+    if joined, ok := err.(interface{ Unwrap() []error }); ok {
+        if errs := joined.Unwrap(); len(errs) > 0 {
+            err = errs[len(errs)-1]
+        }
+    }
+    var cmdErr *commandError
+    if !errors.As(err, &cmdErr) {
+        return reasonUnknown
+    }
+    output := strings.ToLower(cmdErr.Stdout + cmdErr.Stderr)
+    for _, r := range startFailureReasons {
+        for _, pattern := range r.patterns {
+            if strings.Contains(output, pattern) {
+                return r.reason
+            }
+        }
+    }
+    return reasonUnknown
+}
+
+// Start a manifest, retrying retryable failures up to retries times with
+// exponential backoff starting at delay. The returned error describes
+// every failed attempt.
+func startWithRetry(rt Runtime, manifest string, env []string, replace bool, args []string, retries int, delay time.Duration) error {
+    var errs []error
+    for attempt := 0; ; attempt++ {
+        err := rt.Start(manifest, env, replace, args)
+        if err == nil {
+            return nil
+        }
+        errs = append(errs, fmt.Errorf("attempt %d: %w", attempt+1, err))
+        if attempt >= retries || !isRetryableStartError(err) {
+            return errors.Join(errs...)
+        }
+        slog.Warn("Container start failed, retrying", "pod_path", manifest, "attempt", attempt+1, "delay", delay, "error", err)
+        time.Sleep(delay)
+        delay *= 2
+    }
+}
+
+// Keeps track of the manifests a runtime started, for Stop
+type startedManifests struct {
+    mu        sync.Mutex
+    manifests []string
+}
+
+// Remember a started manifest, once even if it was replaced since
+func (s *startedManifests) add(manifest string) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for _, started := range s.manifests {
+        if started == manifest {
+            return
+        }
+    }
+    s.manifests = append(s.manifests, manifest)
+}
+
+// Take manifests started by an earlier process as started, in the order
+// they were started, unless any were started since
+func (s *startedManifests) adopt(manifests []string) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if len(s.manifests) == 0 {
+        s.manifests = append(s.manifests, manifests...)
+    }
+}
+
+// Stop every started manifest in reverse order, forgetting the ones that
+// stopped cleanly
+func (s *startedManifests) stopAll(stop func(manifest string) error) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for len(s.manifests) > 0 {
+        manifest := s.manifests[len(s.manifests)-1]
+        if err := stop(manifest); err != nil {
+            return fmt.Errorf("failed to stop %s: %v", manifest, err)
+        }
+        s.manifests = s.manifests[:len(s.manifests)-1]
+    }
+    return nil
+}
+
+// Forms of the podman subcommand playing a manifest, preferred first.
+// podman 4.3 renamed `play kube` to `kube play`, keeping the old form as
+// an alias, while older builds only know `play kube`.
+var podmanPlayCommands = [][]string{{"kube", "play"}, {"play", "kube"}}
+
+// Timeout of each podman run while detecting the play subcommand
+const podmanDetectTimeout = 10 * time.Second
+
+// Find the form of the play subcommand podman supports, failing if it
+// supports none
+func detectPodmanPlay(podman string) ([]string, error) {
+    for _, play := range podmanPlayCommands {
+        ctx, cancel := context.WithTimeout(context.Background(), podmanDetectTimeout)
+        err := exec.CommandContext(ctx, podman, append(play, "--help")...).Run()
+        cancel()
+        if err == nil {
+            return play, nil
+        }
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), podmanDetectTimeout)
+    defer cancel()
+    version, err := podmanVersion(ctx, podman)
+    if err != nil {
+        version = "of unknown version"
+    }
+    return nil, fmt.Errorf("podman %s at %s supports neither `kube play` nor `play kube`", version, podman)
+}
+
+// Runtime backed by `podman kube play`, or `podman play kube` where that's
+// the form podman supports
+type PodmanRuntime struct {
+    bin       string
+    play      []string
+    placement startPlacement
+    started   startedManifests
+    commands  *runningCommands
+    // tmpfs directory the auth file of an authenticated pull is written to
+    authDir string
+}
+
+// Podman runtime using `play kube`, which New replaces with the form the
+// podman binary supports
+func NewPodmanRuntime(bin string) *PodmanRuntime {
+    return &PodmanRuntime{bin: bin, play: podmanPlayCommands[1], commands: newRunningCommands(), authDir: "/dev/shm"}
+}
+
+// argv of the play subcommand with the given arguments
+func (p *PodmanRuntime) playArgv(args ...string) []string {
+    argv := append([]string{p.bin}, p.play...)
+    return append(argv, args...)
+}
+
+func (p *PodmanRuntime) Command(manifest string, replace bool, args []string) []string {
+    argv := p.playArgv()
+    if replace {
+        argv = append(argv, "--replace")
+    }
+    argv = append(argv, args...)
+    return append(argv, manifest)
+}
+
+func (p *PodmanRuntime) Start(manifest string, env []string, replace bool, args []string) error {
+    if err := p.commands.runPlaced(p.Command(manifest, replace, args), env, p.placement); err != nil {
+        return err
+    }
+    p.started.add(manifest)
+    return nil
+}
+
+func (p *PodmanRuntime) Pull(image string, creds *RegistryCredentials) error {
+    if err := validateImageRef(image); err != nil {
+        return err
+    }
+    argv := []string{p.bin, "pull"}
+    if creds != nil {
+        // Credentials in argv could be read from /proc by any local user,
+        // an auth file only by us
+        authFile, err := writeAuthFile(p.authDir, imageRegistry(image), creds)
+        if err != nil {
+            return err
+        }
+        defer func() {
+            if err := shredFile(authFile); err != nil {
+                slog.Error("Failed to shred registry auth file", "path", authFile, "error", err)
+            }
+        }()
+        argv = append(argv, "--authfile", authFile)
+    }
+    return p.commands.run(append(argv, image), nil)
+}
+
+// Failure to remove what validating a manifest created, as opposed to the
+// manifest being invalid
+var errValidateTeardown = errors.New("failed to remove the validated pods")
+
+// podman has no dry run, so the manifest is played without starting any
+// container and torn down again right away. That also pulls the images.
+// The pods created have the real names, so a failed teardown is an error:
+// they would make the next start fail.
+func (p *PodmanRuntime) Validate(manifest string) error {
+    if err := p.commands.run(p.playArgv("--start=false", manifest), nil); err != nil {
+        return err
+    }
+    if err := p.commands.run(p.playArgv("--down", manifest), nil); err != nil {
+        return fmt.Errorf("%w: %w", errValidateTeardown, err)
+    }
+    return nil
+}
+
+func (p *PodmanRuntime) Stop() error {
+    return p.started.stopAll(func(manifest string) error {
+        return p.commands.run(p.playArgv("--down", manifest), nil)
+    })
+}
+
+func (p *PodmanRuntime) Adopt(manifests []string) {
+    p.started.adopt(manifests)
+}
+
+// Runtime backed by `docker compose`, the manifests being compose files
+type DockerComposeRuntime struct {
+    bin       string
+    placement startPlacement
+    started   startedManifests
+    commands  *runningCommands
+}
+
+func NewDockerComposeRuntime(bin string) *DockerComposeRuntime {
+    return &DockerComposeRuntime{bin: bin, commands: newRunningCommands()}
+}
+
+func (d *DockerComposeRuntime) Command(manifest string, replace bool, args []string) []string {
+    argv := []string{d.bin, "compose", "-f", manifest, "up", "-d"}
+    if replace {
+        argv = append(argv, "--force-recreate")
+    }
+    return append(argv, args...)
+}
+
+func (d *DockerComposeRuntime) Start(manifest string, env []string, replace bool, args []string) error {
+    if err := d.commands.runPlaced(d.Command(manifest, replace, args), env, d.placement); err != nil {
+        return err
+    }
+    d.started.add(manifest)
+    return nil
+}
+
+// docker has no way to pass credentials to a single pull, they'd have to
+// be stored with `docker login` first
+func (d *DockerComposeRuntime) Pull(image string, creds *RegistryCredentials) error {
+    if err := validateImageRef(image); err != nil {
+        return err
+    }
+    if creds != nil {
+        return errors.New("the docker-compose runtime does not support registry credentials")
+    }
+    return d.commands.run([]string{d.bin, "pull", image}, nil)
+}
+
+func (d *DockerComposeRuntime) Validate(manifest string) error {
+    return d.commands.run([]string{d.bin, "compose", "-f", manifest, "config", "--quiet"}, nil)
+}
+
+func (d *DockerComposeRuntime) Stop() error {
+    return d.started.stopAll(func(manifest string) error {
+        return d.commands.run([]string{d.bin, "compose", "-f", manifest, "down"}, nil)
+    })
+}
+
+func (d *DockerComposeRuntime) Adopt(manifests []string) {
+    d.started.adopt(manifests)
+}
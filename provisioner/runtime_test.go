@@ -0,0 +1,55 @@
+package provisioner
+
+import (
+    "path/filepath"
+    "testing"
+    "time"
+
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/require"
+)
+
+// Wait until c has a command running
+func requireRunning(t *testing.T, c *runningCommands) {
+    require.Eventually(t, func() bool {
+        c.mu.Lock()
+        defer c.mu.Unlock()
+        return len(c.done) > 0
+    }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestRunningCommandsWaitForForkedChild(t *testing.T) {
+    marker := filepath.Join(t.TempDir(), "child-done")
+    c := newRunningCommands()
+
+    // The command exits right away, the child it forks keeps its output
+    // open a little longer
+    ran := make(chan error, 1)
+    go func() {
+        ran <- c.run([]string{"sh", "-c", `(sleep 0.3; touch "$0") & echo forked`, marker}, nil)
+    }()
+    requireRunning(t, c)
+
+    c.wait(5 * time.Second)
+    assert.FileExists(t, marker)
+    select {
+    case err := <-ran:
+        assert.NoError(t, err)
+    case <-time.After(time.Second):
+        t.Fatal("command still running after wait returned")
+    }
+}
+
+func TestRunningCommandsWaitGivesUp(t *testing.T) {
+    c := newRunningCommands()
+    ran := make(chan error, 1)
+    go func() {
+        ran <- c.run([]string{"sleep", "1"}, nil)
+    }()
+    requireRunning(t, c)
+
+    started := time.Now()
+    c.wait(100 * time.Millisecond)
+    assert.Less(t, time.Since(started), time.Second)
+    require.NoError(t, <-ran)
+}
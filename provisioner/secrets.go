@@ -0,0 +1,96 @@
+package provisioner
+
+import (
+    "encoding/base64"
+    "encoding/json"
+    "fmt"
+    "os"
+    "path/filepath"
+    "strings"
+
+    "golang.org/x/sys/unix"
+)
+
+// Form field of the secrets file. Like env it holds KEY=VALUE pairs passed
+// to the runtime, but it only lives on tmpfs and is shredded once started.
+const secretsField = "secrets"
+
+// Make sure secrets written to path only ever live in memory
+func checkTmpfs(path string) error {
+    var st unix.Statfs_t
+    if err := unix.Statfs(filepath.Dir(path), &st); err != nil {
+        return err
+    }
+    if st.Type != unix.TMPFS_MAGIC && st.Type != unix.RAMFS_MAGIC {
+        return fmt.Errorf("%s is not on tmpfs", filepath.Dir(path))
+    }
+    return nil
+}
+
+// Overwrite a file with zeros before removing it, so its content doesn't
+// linger in freed pages
+func shredFile(path string) error {
+    f, err := os.OpenFile(path, os.O_WRONLY, 0)
+    if err != nil {
+        return err
+    }
+    info, err := f.Stat()
+    if err != nil {
+        f.Close()
+        return err
+    }
+    if _, err := f.Write(make([]byte, info.Size())); err != nil {
+        f.Close()
+        return fmt.Errorf("failed to overwrite %s: %v", path, err)
+    }
+    if err := f.Sync(); err != nil {
+        f.Close()
+        return fmt.Errorf("failed to sync %s: %v", path, err)
+    }
+    if err := f.Close(); err != nil {
+        return err
+    }
+    return os.Remove(path)
+}
+
+// Registry an image is pulled from, docker.io for short names like
+// library/nginx
+func imageRegistry(image string) string {
+    first, _, ok := strings.Cut(image, "/")
+    if ok && (strings.ContainsAny(first, ".:") || first == "localhost") {
+        return first
+    }
+    return "docker.io"
+}
+
+// Write creds for registry to a new podman auth file in dir, which has to
+// be on tmpfs. The file is only readable by us; the caller shreds it once
+// the pull is done.
+func writeAuthFile(dir, registry string, creds *RegistryCredentials) (string, error) {
+    if err := checkTmpfs(filepath.Join(dir, "auth.json")); err != nil {
+        return "", fmt.Errorf("invalid registry auth dir: %v", err)
+    }
+    auth := base64.StdEncoding.EncodeToString([]byte(creds.Username + ":" + creds.Password))
+    data, err := json.Marshal(map[string]any{
+        "auths": map[string]any{registry: map[string]string{"auth": auth}},
+    })
+    if err != nil {
+        return "", fmt.Errorf("failed to encode registry auth: %v", err)
+    }
+
+    // CreateTemp creates the file with mode 0600
+    f, err := os.CreateTemp(dir, "registry-auth-*.json")
+    if err != nil {
+        return "", fmt.Errorf("failed to create registry auth file: %v", err)
+    }
+    if _, err := f.Write(data); err != nil {
+        f.Close()
+        os.Remove(f.Name())
+        return "", fmt.Errorf("failed to write registry auth file: %v", err)
+    }
+    if err := f.Close(); err != nil {
+        os.Remove(f.Name())
+        return "", fmt.Errorf("failed to write registry auth file: %v", err)
+    }
+    return f.Name(), nil
+}
@@ -0,0 +1,637 @@
+// Package provisioner implements the pod provisioning server: it accepts
+// pod manifests and an env file over HTTP, measures them into the TPM and
+// starts them with a container runtime, shutting itself down once the pod
+// is up.
+package provisioner
+
+import (
+    "context"
+    "crypto"
+    "errors"
+    "fmt"
+    "log/slog"
+    "net"
+    "net/http"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "time"
+
+    "golang.org/x/net/http2"
+    "golang.org/x/net/http2/h2c"
+    "golang.org/x/time/rate"
+)
+
+// Settings of a Server. DefaultConfig returns the values the standalone
+// server uses when no flags are given.
+type Config struct {
+    // Where to record measurements: pcr, nv or both
+    MeasurementTarget string
+    // TPM NV extend index, required when MeasurementTarget includes nv
+    NVIndex uint32
+    // TPM device or simulator socket; without one PCR measurements are only logged
+    TPMDevice string
+    // Hash algorithm and PCR bank used for measurements: sha1, sha256 or sha384
+    PCRHash string
+    // PCR extended with a summary of everything provisioned after each
+    // successful /upload and /start; 0 disables it
+    SummaryPCR int
+    // Backend PCR measurements go to: tpm, agent or noop. Empty picks tpm
+    // with a TPMDevice and noop without.
+    Measurer string
+    // Attestation agent endpoint for measurer agent, an http:// URL, and
+    // the Unix socket to reach it over instead of TCP, if any
+    AgentURL    string
+    AgentSocket string
+
+    // Container runtime: podman or docker-compose
+    Runtime string
+    // Runtime binaries, looked up in PATH unless they contain a slash
+    PodmanBin string
+    DockerBin string
+    // Measure uploads but only report what /start would run
+    DryRun bool
+    // How often to retry a failed container start, and the delay before
+    // the first retry, doubled after each attempt
+    StartRetries    int
+    StartRetryDelay time.Duration
+    // After /start, wait up to HealthcheckTimeout for containers with a
+    // HEALTHCHECK to pass, polling every HealthcheckInterval; 0 disables
+    HealthcheckTimeout  time.Duration
+    HealthcheckInterval time.Duration
+    // How long the response to a /start with an Idempotency-Key is
+    // replayed to retries with the same key
+    IdempotencyTTL time.Duration
+    // cgroup v2 directory the start command is created in, and its
+    // oom_score_adj; empty and nil inherit the provisioner's
+    StartCgroup      string
+    StartOOMScoreAdj *int
+
+    // Maximum size of an /upload request body, also bounding fetched and
+    // decompressed manifests
+    MaxUploadBytes int64
+    // Timeout for fetching a manifest given as pod_url
+    FetchTimeout time.Duration
+    // How long an unfinished resumable upload below /upload/ is kept
+    // without receiving anything
+    ResumableUploadTTL time.Duration
+    // Image prefixes manifests may use; empty allows any image
+    AllowedRegistries []string
+    // Maximum number of YAML documents across the manifests of an upload
+    MaxDocuments int
+    // Kinds the documents may have with the podman runtime; empty allows any
+    AllowedKinds []string
+    // PEM file with the public keys manifests must be signed with as DSSE
+    // envelopes; empty accepts bare manifests
+    EnvelopeKeysFile string
+    // Directory the manifests are written to, pod.yaml and pod.<n>.yaml,
+    // and where the env file goes
+    ManifestDir string
+    EnvPath     string
+    // Where the provisioning state is persisted and the measurement event
+    // log and audit log are appended to
+    StatePath    string
+    EventLogPath string
+    AuditLogPath string
+    // Directory /measure stores extra files in; empty disables /measure
+    MeasureDir string
+    // tmpfs path the secrets upload is written to, shredded once /start
+    // handed it to the runtime, and the PCR it's measured into; empty
+    // rejects secrets
+    SecretsPath string
+    SecretsPCR  int
+    // tmpfs directory registry credentials given to /pull are written to
+    // for podman, for the duration of the pull
+    RegistryAuthDir string
+    // Modes of the written manifests and env file
+    PodMode os.FileMode
+    EnvMode os.FileMode
+    // Directory for the temp files written files are renamed from, used
+    // for the targets on the same filesystem; empty keeps them next to
+    // their targets
+    TempDir string
+    // How often to retry a rename failing with one of RenameRetryErrnos
+    RenameRetries     int
+    RenameRetryErrnos []string
+
+    // TCP address to listen on, unless UnixSocket is set
+    ListenAddr string
+    UnixSocket string
+    // Bearer token required by all endpoints but /healthz and /version, or
+    // @/path/to/file to read it from; empty disables authentication
+    AuthToken string
+    // Origins allowed to call the API from a browser
+    CORSOrigins []string
+    // Serve HTTP/2 without TLS (h2c) next to HTTP/1.1, for deployments
+    // terminating TLS in front of the server
+    H2C bool
+    // Requests per second allowed to the mutating endpoints, 0 disables
+    // rate limiting, and how many of them may come at once
+    RateLimit float64
+    RateBurst int
+    // Timeouts of the HTTP server against slow or idle clients; 0 disables
+    // one. WriteTimeout is lifted for the streaming endpoints and those
+    // waiting on the runtime.
+    ReadHeaderTimeout time.Duration
+    ReadTimeout       time.Duration
+    WriteTimeout      time.Duration
+    IdleTimeout       time.Duration
+    // How long shutdown waits for in-flight requests
+    ShutdownTimeout time.Duration
+    // Fail Run if no /start succeeded this long after it was called, so
+    // a supervisor can mark the boot failed; 0 waits forever
+    ProvisionDeadline time.Duration
+    // Tear down the started pod when the server exits, waiting up to
+    // TeardownTimeout for the runtime; otherwise the pod outlives it
+    TeardownOnExit  bool
+    TeardownTimeout time.Duration
+}
+
+// The configuration used when nothing is overridden
+func DefaultConfig() Config {
+    return Config{
+        MeasurementTarget:   "pcr",
+        PCRHash:             "sha256",
+        Runtime:             "podman",
+        PodmanBin:           "podman",
+        DockerBin:           "docker",
+        StartRetryDelay:     2 * time.Second,
+        HealthcheckInterval: 2 * time.Second,
+        IdempotencyTTL:      time.Hour,
+        MaxUploadBytes:      10 << 20,
+        FetchTimeout:        30 * time.Second,
+        ResumableUploadTTL:  10 * time.Minute,
+        MaxDocuments:        50,
+        ManifestDir:         "/tmp",
+        EnvPath:             "/tmp/env",
+        StatePath:           "/tmp/provisioner-state.json",
+        EventLogPath:        "/tmp/event.log",
+        AuditLogPath:        "/tmp/audit.log",
+        SecretsPCR:          15,
+        RegistryAuthDir:     "/dev/shm",
+        AllowedKinds:        []string{"Pod", "Deployment", "DaemonSet", "Job", "ConfigMap", "Secret", "PersistentVolumeClaim"},
+        PodMode:             0600,
+        EnvMode:             0600,
+        RenameRetries:       3,
+        RenameRetryErrnos:   []string{"EBUSY", "ESTALE"},
+        ListenAddr:          ":24070",
+        RateBurst:           5,
+        ReadHeaderTimeout:   10 * time.Second,
+        ReadTimeout:         time.Minute,
+        WriteTimeout:        time.Minute,
+        IdleTimeout:         2 * time.Minute,
+        ShutdownTimeout:     10 * time.Second,
+        TeardownTimeout:     30 * time.Second,
+    }
+}
+
+// A provisioning server. It serves until a successful /start or until the
+// context given to Run is cancelled.
+type Server struct {
+    cfg Config
+
+    // Absolute path of the podman binary, the form of its play subcommand
+    // and its version, resolved once by New; empty with other runtimes
+    podmanPath    string
+    podmanPlay    string
+    podmanVersion string
+    runtime    Runtime
+    // Runtime commands still running, waited for on shutdown
+    commands *runningCommands
+    // Writer of every file but the logs, with the configured temp dir and
+    // rename retries
+    files *fileWriter
+
+    measurement  measurementConfig
+    envelopeKeys []crypto.PublicKey
+    // From Config.AllowedKinds, nil if any kind is allowed
+    allowedKinds map[string]bool
+    tokens       *tokenStore
+    audit        *auditLog
+    idempotency  *idempotencyCache
+    resumable    *resumableUploads
+
+    state      *provisioningState
+    startMu    sync.Mutex
+    shutdownCh chan struct{}
+
+    handler http.Handler
+}
+
+// Validate cfg, open the TPM and restore the state left by a previous
+// run. The returned Server is ready to Run.
+func New(cfg Config) (_ *Server, err error) {
+    s := &Server{cfg: cfg, commands: newRunningCommands(), shutdownCh: make(chan struct{})}
+    defer func() {
+        if err != nil && s.measurement.tpm != nil {
+            s.measurement.tpm.Close()
+        }
+    }()
+
+    // Refuse to start in an environment requests would only fail in. The
+    // TPM the checks opened is the one measurements go to.
+    results, env := runChecks(cfg)
+    s.measurement.tpm = env.tpm
+    if err := checkFailures(results); err != nil {
+        return nil, err
+    }
+    s.resumable = newResumableUploads(cfg.ResumableUploadTTL)
+
+    placement, err := newStartPlacement(cfg.StartCgroup, cfg.StartOOMScoreAdj)
+    if err != nil {
+        return nil, err
+    }
+
+    // The runtime binary was resolved by the checks, rather than on every
+    // request. In dry-run mode nothing is executed, so the binary needn't
+    // exist.
+    switch cfg.Runtime {
+    case "podman":
+        s.podmanPath = env.runtimePath
+        podman := NewPodmanRuntime(s.podmanPath)
+        podman.placement = placement
+        podman.commands = s.commands
+        podman.authDir = cfg.RegistryAuthDir
+        if env.podmanPlay != nil {
+            podman.play = env.podmanPlay
+        }
+        s.podmanPlay = strings.Join(podman.play, " ")
+        s.runtime = podman
+        if !cfg.DryRun {
+            ctx, cancel := context.WithTimeout(context.Background(), podmanDetectTimeout)
+            s.podmanVersion, err = podmanVersion(ctx, s.podmanPath)
+            cancel()
+            if err != nil {
+                slog.Warn("Failed to get podman version", "error", err)
+            }
+        }
+        // Compose files have no kinds, only check them for Kubernetes YAML
+        if len(cfg.AllowedKinds) > 0 {
+            s.allowedKinds = make(map[string]bool)
+            for _, kind := range cfg.AllowedKinds {
+                s.allowedKinds[kind] = true
+            }
+        }
+    case "docker-compose":
+        docker := NewDockerComposeRuntime(env.runtimePath)
+        docker.placement = placement
+        docker.commands = s.commands
+        s.runtime = docker
+    default:
+        return nil, fmt.Errorf("invalid runtime %q (want podman or docker-compose)", cfg.Runtime)
+    }
+
+    transientErrnos, err := parseErrnos(cfg.RenameRetryErrnos)
+    if err != nil {
+        return nil, fmt.Errorf("invalid rename retry errnos: %v", err)
+    }
+    s.files = newFileWriter(cfg.RenameRetries, transientErrnos)
+
+    if err := s.setupMeasurement(env.bank); err != nil {
+        return nil, err
+    }
+
+    if cfg.MeasureDir != "" {
+        s.cfg.MeasureDir, err = filepath.Abs(cfg.MeasureDir)
+        if err != nil {
+            return nil, fmt.Errorf("invalid measure directory %s: %v", cfg.MeasureDir, err)
+        }
+        if info, err := os.Stat(s.cfg.MeasureDir); err != nil || !info.IsDir() {
+            return nil, fmt.Errorf("invalid measure directory %s, not a directory", cfg.MeasureDir)
+        }
+        // An extra file must never take the place of one /start consumes
+        // or the server keeps for itself
+        own := []string{cfg.ManifestDir, filepath.Dir(cfg.EnvPath), filepath.Dir(cfg.StatePath), filepath.Dir(cfg.EventLogPath), filepath.Dir(cfg.AuditLogPath)}
+        if cfg.SecretsPath != "" {
+            own = append(own, filepath.Dir(cfg.SecretsPath))
+        }
+        for _, dir := range own {
+            if abs, err := filepath.Abs(dir); err == nil && abs == s.cfg.MeasureDir {
+                return nil, fmt.Errorf("invalid measure directory %s, the server keeps its own files there", cfg.MeasureDir)
+            }
+        }
+    }
+
+    if cfg.TempDir != "" {
+        targets := []string{cfg.ManifestDir, filepath.Dir(cfg.EnvPath), filepath.Dir(cfg.StatePath)}
+        if s.cfg.MeasureDir != "" {
+            targets = append(targets, s.cfg.MeasureDir)
+        }
+        if cfg.SecretsPath != "" {
+            targets = append(targets, filepath.Dir(cfg.SecretsPath))
+        }
+        if err := s.files.setTempDir(cfg.TempDir, targets); err != nil {
+            return nil, fmt.Errorf("invalid temp dir: %v", err)
+        }
+    }
+
+    // Load the keys trusted to sign manifest envelopes
+    if cfg.EnvelopeKeysFile != "" {
+        s.envelopeKeys, err = loadPublicKeys(cfg.EnvelopeKeysFile)
+        if err != nil {
+            return nil, fmt.Errorf("invalid envelope keys %s: %v", cfg.EnvelopeKeysFile, err)
+        }
+    }
+
+    if cfg.AuthToken != "" {
+        s.tokens, err = newTokenStore(cfg.AuthToken)
+        if err != nil {
+            return nil, fmt.Errorf("invalid auth token: %v", err)
+        }
+    }
+
+    // Recover from writes interrupted by a crash
+    podYamlPath := podManifestPath(cfg.ManifestDir, 0)
+    s.files.cleanupTempFiles(
+        podYamlPath,
+        podYamlPath+envelopeSuffix,
+        podManifestGlob(cfg.ManifestDir),
+        podManifestGlob(cfg.ManifestDir)+envelopeSuffix,
+        cfg.EnvPath,
+        cfg.StatePath,
+    )
+    if s.cfg.MeasureDir != "" {
+        s.files.cleanupTempFiles(filepath.Join(s.cfg.MeasureDir, "*"))
+    }
+    if s.cfg.SecretsPath != "" {
+        s.files.cleanupTempFiles(s.cfg.SecretsPath)
+    }
+
+    s.audit, err = openAuditLog(cfg.AuditLogPath, cfg.SecretsPath)
+    if err != nil {
+        return nil, err
+    }
+
+    // Restore provisioning state left by a previous run
+    s.state, err = loadState(cfg.StatePath, s.files)
+    if err != nil {
+        return nil, fmt.Errorf("failed to restore provisioning state: %v", err)
+    }
+    s.state.removeUnmeasured(s.storedFiles())
+    if !fileExists(podYamlPath) {
+        s.state.uploaded = false
+    }
+    s.idempotency = newIdempotencyCache(cfg.IdempotencyTTL, s.state)
+    slog.Info("Restored provisioning state", "uploaded", s.state.uploaded, "started", s.state.started)
+
+    s.handler = s.routes()
+    return s, nil
+}
+
+// Resolve measurement targets and the measurer, the TPM having been opened
+// and checked along with the PCRs of bank by the startup checks
+func (s *Server) setupMeasurement(bank []byte) error {
+    pcrTarget, nvTarget, err := parseMeasurementTarget(s.cfg.MeasurementTarget)
+    if err != nil {
+        return err
+    }
+    s.measurement.pcr = pcrTarget
+    s.measurement.nv = nvTarget
+
+    hashAlg, ok := pcrHashAlgorithms[s.cfg.PCRHash]
+    if !ok {
+        return fmt.Errorf("invalid PCR hash %q (want sha1, sha256 or sha384)", s.cfg.PCRHash)
+    }
+    s.measurement.hashName = s.cfg.PCRHash
+    s.measurement.hashAlg = hashAlg.alg
+    s.measurement.hash = hashAlg.hash
+
+    s.measurement.summaryPCR = s.cfg.SummaryPCR
+    s.measurement.eventLog = s.cfg.EventLogPath
+
+    // Without a TPM device nothing is extended unless asked to
+    measurer := s.cfg.Measurer
+    if measurer == "" {
+        measurer = "noop"
+        if s.cfg.TPMDevice != "" {
+            measurer = "tpm"
+        }
+    }
+    if measurer == "tpm" && s.cfg.TPMDevice == "" {
+        return errors.New("a TPM device is required for measurer tpm")
+    }
+
+    switch measurer {
+    case "tpm":
+        // The cached PCR selection of the bank, checked to hold the
+        // measured PCRs
+        s.measurement.measurer = NewTPMMeasurer(s.measurement.tpm, s.cfg.PCRHash, hashAlg.alg, bank)
+    case "agent":
+        if s.cfg.AgentURL == "" {
+            return errors.New("an agent URL is required for measurer agent")
+        }
+        agent, err := NewAgentMeasurer(s.cfg.AgentURL, s.cfg.AgentSocket, s.cfg.PCRHash)
+        if err != nil {
+            return err
+        }
+        s.measurement.measurer = agent
+    case "noop":
+        s.measurement.measurer = NoopMeasurer{}
+    default:
+        return fmt.Errorf("unknown measurer %q (want tpm, agent or noop)", measurer)
+    }
+
+    if nvTarget {
+        if s.cfg.NVIndex == 0 {
+            return fmt.Errorf("an NV index is required for measurement target %s", s.cfg.MeasurementTarget)
+        }
+        if s.measurement.tpm == nil {
+            return fmt.Errorf("a TPM device is required for measurement target %s", s.cfg.MeasurementTarget)
+        }
+        s.measurement.nvIndex = s.cfg.NVIndex
+    }
+    return nil
+}
+
+// Every file /upload and /env write that /start consumes: the manifests,
+// their envelopes, the env and the secrets
+func (s *Server) storedFiles() []string {
+    manifests := []string{podManifestPath(s.cfg.ManifestDir, 0)}
+    if matches, err := filepath.Glob(podManifestGlob(s.cfg.ManifestDir)); err == nil {
+        manifests = append(manifests, matches...)
+    }
+    var files []string
+    for _, manifest := range manifests {
+        files = append(files, manifest, manifest+envelopeSuffix)
+    }
+    files = append(files, s.cfg.EnvPath)
+    if s.cfg.SecretsPath != "" {
+        files = append(files, s.cfg.SecretsPath)
+    }
+    return files
+}
+
+// The endpoints, wrapped in the middleware the Config asks for
+func (s *Server) routes() http.Handler {
+    mux := http.NewServeMux()
+    mux.HandleFunc("/upload", s.handleUpload)
+    mux.HandleFunc(resumablePrefix, s.handleResumable)
+    mux.HandleFunc("/env", s.handleEnv)
+    mux.HandleFunc("/start", s.handleStart)
+    mux.HandleFunc("/restart", s.handleRestart)
+    mux.HandleFunc("/pull", s.handlePull)
+    mux.HandleFunc("/measure", s.handleMeasure)
+    mux.HandleFunc("/validate", s.handleValidate)
+    mux.HandleFunc("/status", s.handleStatus)
+    mux.HandleFunc("/healthz", s.handleHealthz)
+    mux.HandleFunc("/version", s.handleVersion)
+    mux.HandleFunc("/ready", s.handleReady)
+    mux.HandleFunc("/containers", s.handleContainers)
+    mux.HandleFunc("/events", s.handleEvents)
+    mux.HandleFunc("/audit", s.handleAudit)
+
+    // The rate limit goes inside the token check, so requests without a
+    // valid token can't use up the bucket and lock out the operator
+    var handler http.Handler = mux
+    if s.cfg.RateLimit > 0 {
+        handler = rateLimit(rate.NewLimiter(rate.Limit(s.cfg.RateLimit), s.cfg.RateBurst), handler)
+    }
+    if s.tokens != nil {
+        handler = requireToken(s.tokens, handler)
+    }
+    if len(s.cfg.CORSOrigins) > 0 {
+        handler = allowCORS(s.cfg.CORSOrigins, handler)
+    }
+    handler = logRequests(handler)
+    if s.cfg.H2C {
+        // ServeConn only knows the idle timeout of the http2.Server, not
+        // that of the http.Server the connection came in on
+        handler = h2c.NewHandler(handler, &http2.Server{IdleTimeout: s.cfg.IdleTimeout})
+    }
+    return handler
+}
+
+// Re-read the auth token from its source, keeping the old one on failure
+func (s *Server) ReloadAuthToken() error {
+    if s.tokens == nil {
+        return errors.New("no auth token configured")
+    }
+    return s.tokens.reload()
+}
+
+// Serve until a successful /start or until ctx is cancelled, then shut down
+// gracefully, waiting up to the configured timeout for in-flight requests.
+// The TPM is closed when Run returns, so a Server can only be run once.
+func (s *Server) Run(ctx context.Context) error {
+    if s.measurement.tpm != nil {
+        defer s.measurement.tpm.Close()
+    }
+
+    // Listen on either TCP or a Unix socket
+    var ln net.Listener
+    var err error
+    if s.cfg.UnixSocket != "" {
+        ln, err = listenUnix(s.cfg.UnixSocket)
+        if err == nil {
+            // Unlink the socket however Serve returns
+            defer os.Remove(s.cfg.UnixSocket)
+        }
+    } else {
+        ln, err = net.Listen("tcp", s.cfg.ListenAddr)
+    }
+    if err != nil {
+        return fmt.Errorf("failed to listen: %v", err)
+    }
+    if s.cfg.TeardownOnExit {
+        // Runs once the server stopped, however it stopped
+        defer s.teardown()
+    }
+
+    server := &http.Server{
+        Handler:           s.handler,
+        ReadHeaderTimeout: s.cfg.ReadHeaderTimeout,
+        ReadTimeout:       s.cfg.ReadTimeout,
+        WriteTimeout:      s.cfg.WriteTimeout,
+        IdleTimeout:       s.cfg.IdleTimeout,
+    }
+
+    // Give up on provisioning if no /start succeeds before the deadline
+    var deadline <-chan time.Time
+    if s.cfg.ProvisionDeadline > 0 && !s.state.isStarted() {
+        timer := time.NewTimer(s.cfg.ProvisionDeadline)
+        defer timer.Stop()
+        deadline = timer.C
+    }
+    var deadlineErr error
+
+    // Handle graceful shutdown, after /start, once ctx is cancelled or
+    // once the provisioning deadline passed
+    var wg sync.WaitGroup
+    serveDone := make(chan struct{})
+    wg.Add(1)
+    go func() {
+        defer wg.Done()
+        for {
+            select {
+            case <-s.shutdownCh:
+            case <-ctx.Done():
+            case <-serveDone:
+                return
+            case <-deadline:
+                // A start that got the pod up counts, even if the server
+                // stayed up because its healthchecks failed
+                if s.state.isStarted() {
+                    deadline = nil
+                    continue
+                }
+                deadlineErr = fmt.Errorf("no successful /start within the provisioning deadline of %v", s.cfg.ProvisionDeadline)
+                slog.Error("Provisioning deadline passed", "deadline", s.cfg.ProvisionDeadline)
+            }
+            break
+        }
+        slog.Info("Shutting down server", "timeout", s.cfg.ShutdownTimeout)
+        notifySystemd("STOPPING=1")
+
+        // Let in-flight requests finish, cutting them off once the timeout elapses
+        shutdownCtx, cancel := context.WithTimeout(context.Background(), s.cfg.ShutdownTimeout)
+        defer cancel()
+        if err := server.Shutdown(shutdownCtx); err != nil {
+            slog.Warn("Graceful shutdown timed out, closing remaining connections", "error", err)
+            server.Close()
+        }
+    }()
+
+    // Start the server. The listener is bound already, so connections are
+    // accepted from here on and systemd can consider the unit started.
+    slog.Info("Server starting", "addr", ln.Addr().String())
+    notifySystemd("READY=1")
+    err = server.Serve(ln)
+    if err != http.ErrServerClosed {
+        close(serveDone)
+        wg.Wait()
+        s.commands.wait(s.cfg.ShutdownTimeout)
+        return fmt.Errorf("server error: %v", err)
+    }
+
+    // Wait for shutdown to complete, including runtime commands of
+    // requests that were cut off
+    wg.Wait()
+    s.commands.wait(s.cfg.ShutdownTimeout)
+    slog.Info("Server shutdown complete")
+    return deadlineErr
+}
+
+// Stop whatever the runtime started, giving up after TeardownTimeout so a
+// hanging runtime can't keep the process from exiting
+func (s *Server) teardown() {
+    // A pod started before a restart is only known from the state file
+    if s.state.isStarted() {
+        s.runtime.Adopt(listPodManifests(s.cfg.ManifestDir))
+    }
+    slog.Info("Tearing down pod", "timeout", s.cfg.TeardownTimeout)
+    done := make(chan error, 1)
+    go func() {
+        done <- s.runtime.Stop()
+    }()
+    select {
+    case err := <-done:
+        if err != nil {
+            slog.Error("Pod teardown failed", "error", err)
+            return
+        }
+        slog.Info("Pod torn down")
+    case <-time.After(s.cfg.TeardownTimeout):
+        slog.Error("Pod teardown timed out", "timeout", s.cfg.TeardownTimeout)
+    }
+}
@@ -0,0 +1,520 @@
+package provisioner
+
+import (
+    "bytes"
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "mime/multipart"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "slices"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/require"
+)
+
+// Podman stand-in logging every invocation to calls.log next to it, one
+// line of argv each, and succeeding at all of them
+const fakePodman = `#!/bin/sh
+echo "$*" >> "$(dirname "$0")/calls.log"
+case "$*" in
+--version) echo "podman version 4.9.3" ;;
+esac
+exit 0
+`
+
+// A manifest of one pod
+const testManifest = `apiVersion: v1
+kind: Pod
+metadata:
+  name: web
+spec:
+  containers:
+  - name: web
+    image: docker.io/library/nginx:latest
+`
+
+// Measurer recording every extension, failing those fail returns an
+// error for
+type recordingMeasurer struct {
+    mu       sync.Mutex
+    extended []string
+    fail     func(path string) error
+}
+
+func (m *recordingMeasurer) Extend(path string, index int, digest []byte) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if m.fail != nil {
+        if err := m.fail(path); err != nil {
+            return err
+        }
+    }
+    m.extended = append(m.extended, path)
+    return nil
+}
+
+// Paths extended so far, in order
+func (m *recordingMeasurer) paths() []string {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    return append([]string(nil), m.extended...)
+}
+
+// A server writing everything below a temp dir and running the fake
+// podman, measuring into a recordingMeasurer
+type testServer struct {
+    *Server
+    measurer *recordingMeasurer
+}
+
+// Config keeping every path below a temp dir, with the fake podman
+func testConfig(t *testing.T) Config {
+    t.Helper()
+    dir := t.TempDir()
+    bin := filepath.Join(dir, "bin")
+    require.NoError(t, os.Mkdir(bin, 0755))
+    require.NoError(t, os.WriteFile(filepath.Join(bin, "podman"), []byte(fakePodman), 0755))
+
+    cfg := DefaultConfig()
+    cfg.ManifestDir = dir
+    cfg.EnvPath = filepath.Join(dir, "env")
+    cfg.StatePath = filepath.Join(dir, "provisioner-state.json")
+    cfg.EventLogPath = filepath.Join(dir, "event.log")
+    cfg.AuditLogPath = filepath.Join(dir, "audit.log")
+    cfg.PodmanBin = filepath.Join(bin, "podman")
+    cfg.Measurer = "noop"
+    cfg.StartRetryDelay = 0
+    return cfg
+}
+
+// Create a test server, letting configure adjust the config first
+func newTestServer(t *testing.T, configure func(*Config)) *testServer {
+    t.Helper()
+    cfg := testConfig(t)
+    if configure != nil {
+        configure(&cfg)
+    }
+    return newTestServerFrom(t, cfg)
+}
+
+// Create a test server from cfg, like a restart with the same config
+func newTestServerFrom(t *testing.T, cfg Config) *testServer {
+    t.Helper()
+    s, err := New(cfg)
+    require.NoError(t, err)
+    measurer := &recordingMeasurer{}
+    s.measurement.measurer = measurer
+    return &testServer{Server: s, measurer: measurer}
+}
+
+// Replace the fake podman with script, for failures a test needs
+func (ts *testServer) setPodman(t *testing.T, script string) {
+    require.NoError(t, os.WriteFile(ts.cfg.PodmanBin, []byte(script), 0755))
+}
+
+// Invocations of the fake podman so far, one argv line each
+func (ts *testServer) podmanCalls(t *testing.T) []string {
+    data, err := os.ReadFile(filepath.Join(filepath.Dir(ts.cfg.PodmanBin), "calls.log"))
+    if os.IsNotExist(err) {
+        return nil
+    }
+    require.NoError(t, err)
+    return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+// Manifests passed to the fake podman's play subcommand so far, in
+// order, teardowns and validations included
+func (ts *testServer) playedManifests(t *testing.T) []string {
+    var played []string
+    for _, call := range ts.podmanCalls(t) {
+        argv := strings.Fields(call)
+        if len(argv) > 2 && argv[0] == "kube" && argv[1] == "play" && strings.HasSuffix(argv[len(argv)-1], ".yaml") {
+            played = append(played, argv[len(argv)-1])
+        }
+    }
+    return played
+}
+
+// Serve req, returning the recorded response
+func (ts *testServer) do(req *http.Request) *httptest.ResponseRecorder {
+    rec := httptest.NewRecorder()
+    ts.handler.ServeHTTP(rec, req)
+    return rec
+}
+
+// One part of a multipart body, a file unless value is set. Files are
+// named after their field unless filename is set.
+type formPart struct {
+    field    string
+    filename string
+    content  string
+    value    bool
+}
+
+// A multipart POST to target, a path or a URL, with parts in the order
+// given
+func multipartRequest(t *testing.T, target string, parts ...formPart) *http.Request {
+    t.Helper()
+    var body bytes.Buffer
+    mw := multipart.NewWriter(&body)
+    for _, part := range parts {
+        if part.value {
+            require.NoError(t, mw.WriteField(part.field, part.content))
+            continue
+        }
+        filename := part.filename
+        if filename == "" {
+            filename = part.field
+        }
+        fw, err := mw.CreateFormFile(part.field, filename)
+        require.NoError(t, err)
+        _, err = fw.Write([]byte(part.content))
+        require.NoError(t, err)
+    }
+    require.NoError(t, mw.Close())
+
+    req, err := http.NewRequest(http.MethodPost, target, &body)
+    require.NoError(t, err)
+    req.Header.Set("Content-Type", mw.FormDataContentType())
+    return req
+}
+
+func TestNewRemovesLeftoverTempFiles(t *testing.T) {
+    var leftovers []string
+    ts := newTestServer(t, func(cfg *Config) {
+        // As left by a process killed between writing and renaming
+        for _, path := range []string{podManifestPath(cfg.ManifestDir, 0), podManifestPath(cfg.ManifestDir, 1), cfg.EnvPath} {
+            leftover := path + tempSuffix + "123456"
+            require.NoError(t, os.WriteFile(leftover, []byte("partial"), 0600))
+            leftovers = append(leftovers, leftover)
+        }
+    })
+    for _, leftover := range leftovers {
+        assert.NoFileExists(t, leftover)
+    }
+
+    resp := ts.do(multipartRequest(t, "/upload",
+        formPart{field: "pod.yaml", content: testManifest},
+        formPart{field: "pod.yaml.1", content: testManifest},
+        formPart{field: "env", content: "FOO=bar\n"}))
+    require.Equal(t, http.StatusCreated, resp.Code, resp.Body.String())
+    data, err := os.ReadFile(podManifestPath(ts.cfg.ManifestDir, 0))
+    require.NoError(t, err)
+    assert.Equal(t, testManifest, string(data))
+}
+
+func TestStartResponseArrivesBeforeShutdown(t *testing.T) {
+    var socket string
+    ts := newTestServer(t, func(cfg *Config) {
+        socket = filepath.Join(cfg.ManifestDir, "s.sock")
+        cfg.UnixSocket = socket
+    })
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    runErr := make(chan error, 1)
+    go func() {
+        runErr <- ts.Run(ctx)
+    }()
+
+    client := &http.Client{Transport: &http.Transport{
+        DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+            var d net.Dialer
+            return d.DialContext(ctx, "unix", socket)
+        },
+    }}
+    require.Eventually(t, func() bool { return fileExists(socket) }, 5*time.Second, 10*time.Millisecond)
+
+    resp, err := client.Do(multipartRequest(t, "http://provisioner/upload", formPart{field: "pod.yaml", content: testManifest}))
+    require.NoError(t, err)
+    resp.Body.Close()
+    require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+    resp, err = client.Post("http://provisioner/start", "", nil)
+    require.NoError(t, err)
+    defer resp.Body.Close()
+    assert.Equal(t, http.StatusOK, resp.StatusCode)
+    var body startResponse
+    require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+    assert.Equal(t, "started", body.Status)
+
+    select {
+    case err := <-runErr:
+        assert.NoError(t, err)
+    case <-time.After(5 * time.Second):
+        t.Fatal("Run did not return after /start")
+    }
+    assert.NoFileExists(t, socket)
+}
+
+func TestRateLimitOnlyCountsAuthenticatedRequests(t *testing.T) {
+    ts := newTestServer(t, func(cfg *Config) {
+        cfg.AuthToken = "secret"
+        cfg.RateLimit = 0.001
+        cfg.RateBurst = 2
+    })
+    status := func(token string) int {
+        req := httptest.NewRequest(http.MethodPost, "/start", nil)
+        if token != "" {
+            req.Header.Set("Authorization", "Bearer "+token)
+        }
+        return ts.do(req).Code
+    }
+
+    // Requests without a valid token don't use up the bucket
+    for _, token := range []string{"", "", "wrong"} {
+        assert.Equal(t, http.StatusUnauthorized, status(token))
+    }
+    assert.Equal(t, http.StatusNotFound, status("secret"))
+    assert.Equal(t, http.StatusNotFound, status("secret"))
+    assert.Equal(t, http.StatusTooManyRequests, status("secret"))
+}
+
+func TestNewRefusesMeasureDirHoldingOwnFiles(t *testing.T) {
+    tests := map[string]func(cfg *Config){
+        "manifest dir": func(cfg *Config) { cfg.MeasureDir = cfg.ManifestDir },
+        "env dir": func(cfg *Config) {
+            cfg.MeasureDir = t.TempDir()
+            cfg.EnvPath = filepath.Join(cfg.MeasureDir, "env")
+        },
+        "state dir": func(cfg *Config) {
+            cfg.MeasureDir = t.TempDir()
+            cfg.StatePath = filepath.Join(cfg.MeasureDir, "state.json")
+        },
+    }
+    for name, configure := range tests {
+        t.Run(name, func(t *testing.T) {
+            cfg := testConfig(t)
+            configure(&cfg)
+            _, err := New(cfg)
+            assert.ErrorContains(t, err, "invalid measure directory")
+        })
+    }
+}
+
+func TestRestartKeepsOnlyMeasuredFiles(t *testing.T) {
+    ts := newTestServer(t, nil)
+    resp := ts.do(multipartRequest(t, "/upload",
+        formPart{field: "pod.yaml", content: testManifest},
+        formPart{field: "env", content: "FOO=bar\n"}))
+    require.Equal(t, http.StatusCreated, resp.Code, resp.Body.String())
+
+    // A second manifest written by a process that died before measuring
+    // it, and an env changed since it was measured
+    unmeasured := podManifestPath(ts.cfg.ManifestDir, 1)
+    require.NoError(t, os.WriteFile(unmeasured, []byte(testManifest), 0600))
+    require.NoError(t, os.WriteFile(ts.cfg.EnvPath, []byte("FOO=evil\n"), 0600))
+
+    restarted := newTestServerFrom(t, ts.cfg)
+    assert.FileExists(t, podManifestPath(ts.cfg.ManifestDir, 0))
+    assert.NoFileExists(t, unmeasured)
+    assert.NoFileExists(t, ts.cfg.EnvPath)
+    uploaded, started, _ := restarted.state.progress()
+    assert.True(t, uploaded)
+    assert.False(t, started)
+}
+
+func TestRestartRemovesUploadNeverMeasured(t *testing.T) {
+    cfg := testConfig(t)
+    // What a crash between writing and measuring an upload leaves
+    require.NoError(t, os.WriteFile(podManifestPath(cfg.ManifestDir, 0), []byte(testManifest), 0600))
+    require.NoError(t, os.WriteFile(cfg.EnvPath, []byte("FOO=bar\n"), 0600))
+
+    ts := newTestServerFrom(t, cfg)
+    assert.NoFileExists(t, podManifestPath(cfg.ManifestDir, 0))
+    assert.NoFileExists(t, cfg.EnvPath)
+    uploaded, _, _ := ts.state.progress()
+    assert.False(t, uploaded)
+
+    resp := ts.do(httptest.NewRequest(http.MethodPost, "/start", nil))
+    assert.Equal(t, http.StatusNotFound, resp.Code, resp.Body.String())
+    assert.Empty(t, ts.playedManifests(t))
+}
+
+func TestTeardownAfterRestartStopsStartedPod(t *testing.T) {
+    ts := newTestServer(t, func(cfg *Config) {
+        cfg.TeardownOnExit = true
+    })
+    resp := ts.do(multipartRequest(t, "/upload",
+        formPart{field: "pod.yaml", content: testManifest},
+        formPart{field: "pod.yaml.1", content: strings.ReplaceAll(testManifest, "web", "second")}))
+    require.Equal(t, http.StatusCreated, resp.Code, resp.Body.String())
+    resp = ts.do(httptest.NewRequest(http.MethodPost, "/start", nil))
+    require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+
+    // Only the state file knows the pod is up
+    restarted := newTestServerFrom(t, ts.cfg)
+    restarted.teardown()
+    var downed []string
+    for _, call := range restarted.podmanCalls(t) {
+        if argv := strings.Fields(call); slices.Contains(argv, "--down") {
+            downed = append(downed, argv[len(argv)-1])
+        }
+    }
+    assert.Equal(t, []string{podManifestPath(ts.cfg.ManifestDir, 1), podManifestPath(ts.cfg.ManifestDir, 0)}, downed)
+}
+
+func TestIdempotentStartReplayedAfterRestart(t *testing.T) {
+    ts := newTestServer(t, nil)
+    resp := ts.do(multipartRequest(t, "/upload", formPart{field: "pod.yaml", content: testManifest}))
+    require.Equal(t, http.StatusCreated, resp.Code, resp.Body.String())
+    start := func(ts *testServer) *httptest.ResponseRecorder {
+        req := httptest.NewRequest(http.MethodPost, "/start", nil)
+        req.Header.Set(idempotencyKeyHeader, "deploy-42")
+        return ts.do(req)
+    }
+    first := start(ts)
+    require.Equal(t, http.StatusOK, first.Code, first.Body.String())
+
+    // The successful start shut the server down, the retry reaches the
+    // next one and must not start again
+    restarted := newTestServerFrom(t, ts.cfg)
+    retry := start(restarted)
+    assert.Equal(t, http.StatusOK, retry.Code, retry.Body.String())
+    assert.Equal(t, "true", retry.Header().Get(idempotentReplayHeader))
+    assert.Equal(t, first.Body.String(), retry.Body.String())
+    assert.Equal(t, []string{podManifestPath(ts.cfg.ManifestDir, 0)}, restarted.playedManifests(t))
+}
+
+func TestDryRunStartReportsDetectedPlayCommand(t *testing.T) {
+    ts := newTestServer(t, func(cfg *Config) {
+        cfg.DryRun = true
+    })
+    resp := ts.do(multipartRequest(t, "/upload", formPart{field: "pod.yaml", content: testManifest}))
+    require.Equal(t, http.StatusCreated, resp.Code, resp.Body.String())
+    resp = ts.do(httptest.NewRequest(http.MethodPost, "/start", nil))
+    require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+
+    var started startResponse
+    require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &started))
+    assert.Equal(t, "dry-run", started.Status)
+    require.Len(t, started.Commands, 1)
+    // The fake podman knows `kube play`, which a real run would use too
+    assert.Equal(t, []string{ts.cfg.PodmanBin, "kube", "play"}, started.Commands[0][:3])
+    assert.Empty(t, ts.playedManifests(t))
+}
+
+func TestReloadAuthTokenFromFile(t *testing.T) {
+    tokenFile := filepath.Join(t.TempDir(), "token")
+    require.NoError(t, os.WriteFile(tokenFile, []byte("first\n"), 0600))
+    ts := newTestServer(t, func(cfg *Config) {
+        cfg.AuthToken = "@" + tokenFile
+    })
+    status := func(token string) int {
+        req := httptest.NewRequest(http.MethodGet, "/status", nil)
+        req.Header.Set("Authorization", "Bearer "+token)
+        return ts.do(req).Code
+    }
+    assert.Equal(t, http.StatusOK, status("first"))
+
+    // A reload, as on SIGHUP, swaps the token
+    require.NoError(t, os.WriteFile(tokenFile, []byte("second\n"), 0600))
+    require.NoError(t, ts.ReloadAuthToken())
+    assert.Equal(t, http.StatusUnauthorized, status("first"))
+    assert.Equal(t, http.StatusOK, status("second"))
+
+    // A failed reload keeps the current token
+    require.NoError(t, os.WriteFile(tokenFile, []byte("\n"), 0600))
+    assert.ErrorContains(t, ts.ReloadAuthToken(), "auth token is empty")
+    require.NoError(t, os.Remove(tokenFile))
+    assert.ErrorContains(t, ts.ReloadAuthToken(), "failed to read token file")
+    assert.Equal(t, http.StatusOK, status("second"))
+
+    // Probes never need the token
+    assert.Equal(t, http.StatusOK, ts.do(httptest.NewRequest(http.MethodGet, "/healthz", nil)).Code)
+}
+
+func TestReloadAuthTokenWithoutToken(t *testing.T) {
+    ts := newTestServer(t, nil)
+    assert.ErrorContains(t, ts.ReloadAuthToken(), "no auth token configured")
+}
+
+// Entries GET /audit lists, checking the chain of the raw lines
+func (ts *testServer) auditEntries(t *testing.T) []auditEntry {
+    resp := ts.do(httptest.NewRequest(http.MethodGet, "/audit", nil))
+    require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+    var entries []auditEntry
+    require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &entries))
+
+    data, err := os.ReadFile(ts.cfg.AuditLogPath)
+    require.NoError(t, err)
+    lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+    require.Len(t, lines, len(entries))
+    prev := ""
+    for i, line := range lines {
+        assert.Equal(t, prev, entries[i].Prev, "entry %d", i)
+        digest := sha256.Sum256([]byte(line))
+        prev = hex.EncodeToString(digest[:])
+    }
+    return entries
+}
+
+func TestAuditLogRecordsUploads(t *testing.T) {
+    ts := newTestServer(t, nil)
+    resp := ts.do(httptest.NewRequest(http.MethodGet, "/audit", nil))
+    require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+    assert.JSONEq(t, "[]", resp.Body.String())
+
+    req := multipartRequest(t, "/upload",
+        formPart{field: "pod.yaml", content: testManifest},
+        formPart{field: "env", content: "FOO=bar\n"})
+    req.RemoteAddr = "192.0.2.1:1234"
+    resp = ts.do(req)
+    require.Equal(t, http.StatusCreated, resp.Code, resp.Body.String())
+
+    entries := ts.auditEntries(t)
+    require.Len(t, entries, 2)
+    manifestDigest := sha256.Sum256([]byte(testManifest))
+    assert.Equal(t, podManifestPath(ts.cfg.ManifestDir, 0), entries[0].Path)
+    assert.Equal(t, len(testManifest), entries[0].Bytes)
+    assert.Equal(t, hex.EncodeToString(manifestDigest[:]), entries[0].SHA256)
+    assert.Equal(t, podPCR, entries[0].PCR)
+    assert.Equal(t, ts.cfg.EnvPath, entries[1].Path)
+    assert.Equal(t, envPCR, entries[1].PCR)
+    for _, entry := range entries {
+        assert.Equal(t, "192.0.2.1:1234", entry.RemoteAddr)
+        assert.Equal(t, entries[0].Time, entry.Time)
+    }
+
+    // A restarted server carries on with the chain
+    restarted := newTestServerFrom(t, ts.cfg)
+    resp = restarted.do(multipartRequest(t, "/env",
+        formPart{field: "env", content: "FOO=baz\n"},
+        formPart{field: "force", content: "true", value: true}))
+    require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+    entries = restarted.auditEntries(t)
+    require.Len(t, entries, 3)
+    assert.Equal(t, ts.cfg.EnvPath, entries[2].Path)
+
+    resp = ts.do(httptest.NewRequest(http.MethodPost, "/audit", nil))
+    assert.Equal(t, http.StatusMethodNotAllowed, resp.Code)
+}
+
+func TestAuditLogOmitsSecretsDigest(t *testing.T) {
+    dir := t.TempDir()
+    secrets, manifest := filepath.Join(dir, "secrets"), filepath.Join(dir, "pod.yaml")
+    require.NoError(t, os.WriteFile(secrets, []byte("TOKEN=hunter2\n"), 0600))
+    require.NoError(t, os.WriteFile(manifest, []byte(testManifest), 0600))
+
+    audit, err := openAuditLog(filepath.Join(dir, "audit.log"), secrets)
+    require.NoError(t, err)
+    require.NoError(t, audit.record([]measuredFile{{path: manifest, pcr: podPCR}, {path: secrets, pcr: 15}}, "192.0.2.1:1234"))
+    entries, err := audit.entries()
+    require.NoError(t, err)
+    require.Len(t, entries, 2)
+    assert.NotEmpty(t, entries[0].SHA256)
+    assert.Empty(t, entries[1].SHA256)
+    assert.Equal(t, len("TOKEN=hunter2\n"), entries[1].Bytes)
+    data, err := os.ReadFile(filepath.Join(dir, "audit.log"))
+    require.NoError(t, err)
+    assert.NotContains(t, string(data), `"sha256":""`)
+}
@@ -0,0 +1,108 @@
+package provisioner
+
+import (
+    "fmt"
+    "regexp"
+    "strings"
+)
+
+// Form field of an extra argument to podman's play subcommand on /start, repeated
+// for several, each --flag=value
+const startArgField = "arg"
+
+// Characters allowed in an extra argument's value. No shell ever sees the
+// argv, but there is no reason for a value to need anything else either.
+var startArgValuePattern = regexp.MustCompile(`^[A-Za-z0-9._:/@,+-]+$`)
+
+// Flags /start may pass to podman's play subcommand, and what their values may be
+var startArgFlags = map[string]func(value string) error{
+    "--network":    checkStartArgNetwork,
+    "--log-driver": checkStartArgValue,
+    "--log-opt":    checkStartArgLogOpt,
+    "--annotation": checkStartArgKeyValue,
+    "--log-level": func(value string) error {
+        switch value {
+        case "trace", "debug", "info", "warn", "error", "fatal", "panic":
+            return nil
+        }
+        return fmt.Errorf("unknown log level %q", value)
+    },
+}
+
+func checkStartArgValue(value string) error {
+    if !startArgValuePattern.MatchString(value) {
+        return fmt.Errorf("invalid value %q", value)
+    }
+    return nil
+}
+
+// Names of networks as podman creates them
+var startArgNetworkPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// Network modes that aren't a named network. They would take the pod out
+// of its own network namespace, into the host's or another container's.
+var startArgNetworkModes = map[string]bool{
+    "host":        true,
+    "none":        true,
+    "private":     true,
+    "bridge":      true,
+    "slirp4netns": true,
+    "pasta":       true,
+}
+
+// A named network, not a mode like host or container:<id>
+func checkStartArgNetwork(value string) error {
+    if !startArgNetworkPattern.MatchString(value) || startArgNetworkModes[value] {
+        return fmt.Errorf("invalid network %q, want the name of a network", value)
+    }
+    return nil
+}
+
+// Log options that only shape the logs. Anything else, like path, could
+// have root podman write wherever the caller likes.
+var startArgLogOpts = map[string]bool{
+    "max-size": true,
+    "tag":      true,
+}
+
+func checkStartArgLogOpt(value string) error {
+    key, _, _ := strings.Cut(value, "=")
+    if !startArgLogOpts[key] {
+        return fmt.Errorf("log option %q is not allowed", key)
+    }
+    return checkStartArgKeyValue(value)
+}
+
+// A key=value value, like that of --annotation
+func checkStartArgKeyValue(value string) error {
+    key, val, ok := strings.Cut(value, "=")
+    if !ok || key == "" {
+        return fmt.Errorf("invalid value %q, want key=value", value)
+    }
+    if err := checkStartArgValue(key); err != nil {
+        return err
+    }
+    if val != "" {
+        return checkStartArgValue(val)
+    }
+    return nil
+}
+
+// Validate the extra arguments given to /start against startArgFlags. They
+// have to be --flag=value, so a value can never be taken for a flag.
+func checkStartArgs(args []string) error {
+    for _, arg := range args {
+        flag, value, ok := strings.Cut(arg, "=")
+        check, allowed := startArgFlags[flag]
+        if !allowed {
+            return fmt.Errorf("argument %q is not allowed", arg)
+        }
+        if !ok {
+            return fmt.Errorf("argument %q must be %s=value", arg, flag)
+        }
+        if err := check(value); err != nil {
+            return fmt.Errorf("argument %s: %v", flag, err)
+        }
+    }
+    return nil
+}
@@ -0,0 +1,255 @@
+package provisioner
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "io/fs"
+    "log/slog"
+    "os"
+    "sync"
+    "syscall"
+    "time"
+)
+
+// Provisioning progress, persisted in the state file so a restarted
+// server picks up where the previous one left off: which files were fully
+// measured, and whether /start succeeded.
+type provisioningState struct {
+    // State file and the writer it's written with
+    path  string
+    files *fileWriter
+
+    mu        sync.Mutex
+    uploaded  bool
+    started   bool
+    startedAt time.Time
+    // How the last successful start went, for /restart to do the same:
+    // the extra runtime arguments and whether secrets were passed
+    startArgs    []string
+    startSecrets bool
+    // SHA-256 of every file written and measured, hex encoded by path.
+    // A file on disk that isn't listed with its digest was written by a
+    // process that died before measuring it.
+    measured map[string]string
+    // Responses to /start by idempotency key
+    responses map[string]cachedResponse
+    // SHA-256 of the files reported by /status, by path
+    digests map[string]fileDigest
+}
+
+// A file's digest along with what identified the file when it was hashed.
+// Files are replaced by renaming, so a changed inode, size or modification
+// time means the digest is stale.
+type fileDigest struct {
+    ino     uint64
+    size    int64
+    modTime time.Time
+    sha256  [sha256.Size]byte
+}
+
+// On-disk form of provisioningState
+type persistedState struct {
+    Started      bool      `json:"started"`
+    StartedAt    time.Time `json:"started_at,omitempty"`
+    StartArgs    []string  `json:"start_args,omitempty"`
+    StartSecrets bool      `json:"start_secrets,omitempty"`
+    Uploaded     bool      `json:"uploaded,omitempty"`
+    // Hex SHA-256 of the measured files, by path
+    Measured map[string]string `json:"measured,omitempty"`
+    // Responses to /start by idempotency key
+    Responses map[string]cachedResponse `json:"idempotency,omitempty"`
+}
+
+// Reconstruct the state from the state file at path
+func loadState(path string, files *fileWriter) (*provisioningState, error) {
+    state := &provisioningState{path: path, files: files, measured: make(map[string]string), digests: make(map[string]fileDigest)}
+
+    data, err := os.ReadFile(path)
+    if errors.Is(err, fs.ErrNotExist) {
+        return state, nil
+    }
+    if err != nil {
+        return nil, fmt.Errorf("failed to read state file: %v", err)
+    }
+
+    var persisted persistedState
+    if err := json.Unmarshal(data, &persisted); err != nil {
+        return nil, fmt.Errorf("failed to parse state file: %v", err)
+    }
+    state.started = persisted.Started
+    state.startedAt = persisted.StartedAt
+    state.startArgs = persisted.StartArgs
+    state.startSecrets = persisted.StartSecrets
+    state.uploaded = persisted.Uploaded
+    if persisted.Measured != nil {
+        state.measured = persisted.Measured
+    }
+    state.responses = persisted.Responses
+    return state, nil
+}
+
+// Remove those of paths that exist but were never fully measured, what a
+// crash between writing and measuring an upload leaves behind. Nothing
+// that isn't measured may ever be started.
+func (s *provisioningState) removeUnmeasured(paths []string) {
+    for _, path := range paths {
+        if !fileExists(path) {
+            continue
+        }
+        _, digest, err := s.fileDigest(path)
+        s.mu.Lock()
+        recorded := s.measured[path]
+        s.mu.Unlock()
+        if err == nil && recorded == hex.EncodeToString(digest[:]) {
+            continue
+        }
+        if err := os.Remove(path); err != nil {
+            slog.Error("Failed to remove file that was never measured", "path", path, "error", err)
+            continue
+        }
+        slog.Warn("Removed file that was never measured", "path", path)
+    }
+}
+
+func (s *provisioningState) isStarted() bool {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.started
+}
+
+// Whether a start succeeded, and with which arguments and secrets
+func (s *provisioningState) lastStart() (started bool, args []string, secrets bool) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.started, s.startArgs, s.startSecrets
+}
+
+// Record the files at paths as measured, persisting it before returning
+func (s *provisioningState) markMeasured(paths []string) error {
+    return s.recordMeasured(paths, false)
+}
+
+// Record a complete upload of the files at paths, persisting it before
+// returning
+func (s *provisioningState) markUploaded(paths []string) error {
+    return s.recordMeasured(paths, true)
+}
+
+func (s *provisioningState) recordMeasured(paths []string, upload bool) error {
+    digests := make(map[string]string, len(paths))
+    for _, path := range paths {
+        _, digest, err := s.fileDigest(path)
+        if err != nil {
+            return err
+        }
+        digests[path] = hex.EncodeToString(digest[:])
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for path, digest := range digests {
+        s.measured[path] = digest
+    }
+    if upload {
+        s.uploaded = true
+    }
+    return s.persist()
+}
+
+// Record a successful start with its extra arguments and whether it used
+// secrets, persisting it before returning
+func (s *provisioningState) markStarted(args []string, secrets bool) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.started = true
+    s.startedAt = time.Now().UTC()
+    s.startArgs = args
+    s.startSecrets = secrets
+    return s.persist()
+}
+
+// The idempotent responses last saved, as a map of the caller's own
+func (s *provisioningState) idempotentResponses() map[string]cachedResponse {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    responses := make(map[string]cachedResponse, len(s.responses))
+    for key, resp := range s.responses {
+        responses[key] = resp
+    }
+    return responses
+}
+
+// Replace the idempotent responses, persisting them before returning
+func (s *provisioningState) saveIdempotentResponses(responses map[string]cachedResponse) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.responses = make(map[string]cachedResponse, len(responses))
+    for key, resp := range responses {
+        s.responses[key] = resp
+    }
+    return s.persist()
+}
+
+// Write the state file, called with mu held
+func (s *provisioningState) persist() error {
+    data, err := json.Marshal(persistedState{
+        Started:      s.started,
+        StartedAt:    s.startedAt,
+        StartArgs:    s.startArgs,
+        StartSecrets: s.startSecrets,
+        Uploaded:     s.uploaded,
+        Measured:     s.measured,
+        Responses:    s.responses,
+    })
+    if err != nil {
+        return fmt.Errorf("failed to encode state: %v", err)
+    }
+    return s.files.atomicWriteFile(s.path, data, 0600)
+}
+
+// Stat the file at path along with its SHA-256, hashing it only if it
+// changed since the last call
+func (s *provisioningState) fileDigest(path string) (fs.FileInfo, [sha256.Size]byte, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, [sha256.Size]byte{}, err
+    }
+    defer f.Close()
+    info, err := f.Stat()
+    if err != nil {
+        return nil, [sha256.Size]byte{}, err
+    }
+    var ino uint64
+    if st, ok := info.Sys().(*syscall.Stat_t); ok {
+        ino = st.Ino
+    }
+
+    s.mu.Lock()
+    cached, ok := s.digests[path]
+    s.mu.Unlock()
+    if ok && cached.ino == ino && cached.size == info.Size() && cached.modTime.Equal(info.ModTime()) {
+        return info, cached.sha256, nil
+    }
+
+    h := sha256.New()
+    if _, err := io.Copy(h, f); err != nil {
+        return nil, [sha256.Size]byte{}, fmt.Errorf("failed to hash %s: %v", path, err)
+    }
+    var digest [sha256.Size]byte
+    h.Sum(digest[:0])
+    s.mu.Lock()
+    s.digests[path] = fileDigest{ino: ino, size: info.Size(), modTime: info.ModTime(), sha256: digest}
+    s.mu.Unlock()
+    return info, digest, nil
+}
+
+// Snapshot of the provisioning progress, for /status
+func (s *provisioningState) progress() (uploaded, started bool, startedAt time.Time) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.uploaded, s.started, s.startedAt
+}
@@ -0,0 +1,71 @@
+package provisioner
+
+import (
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "io/fs"
+    "net/http"
+    "os"
+)
+
+// Content types of the provisioned files
+const (
+    manifestContentType = "application/yaml"
+    envContentType      = "text/plain"
+)
+
+// Status handler: the provisioning progress and an integrity snapshot of
+// every provisioned file, its size, SHA-256, modification time and the PCR
+// it is measured into. Digests are cached until a file is replaced, so
+// polling doesn't rehash large manifests.
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    uploaded, started, startedAt := s.state.progress()
+    resp := statusResponse{Uploaded: uploaded, Started: started, Files: []fileStatus{}}
+    if started {
+        resp.StartedAt = &startedAt
+    }
+
+    files := []fileStatus{}
+    for _, manifest := range listPodManifests(s.cfg.ManifestDir) {
+        files = append(files, fileStatus{Path: manifest, ContentType: manifestContentType, PCR: podPCR})
+    }
+    files = append(files, fileStatus{Path: s.cfg.EnvPath, ContentType: envContentType, PCR: envPCR})
+    for _, file := range files {
+        info, digest, err := s.state.fileDigest(file.Path)
+        if errors.Is(err, fs.ErrNotExist) {
+            continue
+        } else if err != nil {
+            writeError(w, fmt.Sprintf("Failed to read %s: %v", file.Path, err), http.StatusInternalServerError)
+            return
+        }
+        file.Size = info.Size()
+        file.SHA256 = hex.EncodeToString(digest[:])
+        file.ModTime = info.ModTime().UTC()
+        resp.Files = append(resp.Files, file)
+    }
+
+    // The secrets file only gets its metadata reported, and only until
+    // /start shreds it
+    if s.cfg.SecretsPath != "" {
+        info, err := os.Stat(s.cfg.SecretsPath)
+        if err != nil && !errors.Is(err, fs.ErrNotExist) {
+            writeError(w, fmt.Sprintf("Failed to stat %s: %v", s.cfg.SecretsPath, err), http.StatusInternalServerError)
+            return
+        } else if err == nil {
+            resp.Files = append(resp.Files, fileStatus{
+                Path:        s.cfg.SecretsPath,
+                ContentType: envContentType,
+                Size:        info.Size(),
+                ModTime:     info.ModTime().UTC(),
+                PCR:         s.cfg.SecretsPCR,
+            })
+        }
+    }
+    writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,137 @@
+package provisioner
+
+import (
+    "crypto"
+    "fmt"
+
+    "github.com/google/go-tpm/tpm2"
+    "github.com/google/go-tpm/tpm2/transport"
+    "github.com/google/go-tpm/tpmutil"
+)
+
+// Open a connection to the TPM device (or simulator socket) at path
+func openTPM(path string) (transport.TPMCloser, error) {
+    tpm, err := transport.OpenTPM(path)
+    if err != nil {
+        return nil, fmt.Errorf("failed to open TPM %s: %v", path, err)
+    }
+    return tpm, nil
+}
+
+// Hash algorithms selectable as Config.PCRHash, each naming a PCR bank
+var pcrHashAlgorithms = map[string]struct {
+    alg  tpm2.TPMAlgID
+    hash crypto.Hash
+}{
+    "sha1":   {tpm2.TPMAlgSHA1, crypto.SHA1},
+    "sha256": {tpm2.TPMAlgSHA256, crypto.SHA256},
+    "sha384": {tpm2.TPMAlgSHA384, crypto.SHA384},
+}
+
+// PCRs allocated in the bank for alg, as a bitmap indexed by PCR. Fails if
+// the bank isn't active, i.e. has no PCR selected at all.
+func pcrBank(tpm transport.TPM, alg tpm2.TPMAlgID) ([]byte, error) {
+    rsp, err := tpm2.GetCapability{
+        Capability:    tpm2.TPMCapPCRs,
+        Property:      0,
+        PropertyCount: 1,
+    }.Execute(tpm)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read PCR allocation: %v", err)
+    }
+    assigned, err := rsp.CapabilityData.Data.AssignedPCR()
+    if err != nil {
+        return nil, fmt.Errorf("failed to parse PCR allocation: %v", err)
+    }
+
+    for _, sel := range assigned.PCRSelections {
+        if sel.Hash != alg {
+            continue
+        }
+        for _, b := range sel.PCRSelect {
+            if b != 0 {
+                return sel.PCRSelect, nil
+            }
+        }
+    }
+    return nil, fmt.Errorf("TPM has no active PCR bank for algorithm 0x%04x", uint16(alg))
+}
+
+// Whether a PCR is set in a selection bitmap as returned by pcrBank
+func pcrSelected(bank []byte, pcrIndex int) bool {
+    return pcrIndex >= 0 && pcrIndex/8 < len(bank) && bank[pcrIndex/8]&(1<<(pcrIndex%8)) != 0
+}
+
+// Extend a digest into one bank of a PCR
+func pcrExtend(tpm transport.TPM, pcrIndex int, alg tpm2.TPMAlgID, digest []byte) error {
+    _, err := tpm2.PCRExtend{
+        PCRHandle: tpm2.AuthHandle{
+            Handle: tpm2.TPMHandle(pcrIndex),
+            Auth:   tpm2.PasswordAuth(nil),
+        },
+        Digests: tpm2.TPMLDigestValues{
+            Digests: []tpm2.TPMTHA{{HashAlg: alg, Digest: digest}},
+        },
+    }.Execute(tpm)
+    if err != nil {
+        return fmt.Errorf("PCR_Extend of PCR %d failed: %v", pcrIndex, err)
+    }
+    return nil
+}
+
+// Check that the NV index exists and can be extended using its own
+// (empty) auth value
+func validateNVIndex(tpm transport.TPM, index uint32) error {
+    rsp, err := tpm2.NVReadPublic{NVIndex: tpm2.TPMHandle(index)}.Execute(tpm)
+    if err != nil {
+        return fmt.Errorf("failed to read NV index 0x%08x: %v", index, err)
+    }
+    pub, err := rsp.NVPublic.Contents()
+    if err != nil {
+        return fmt.Errorf("failed to parse NV index 0x%08x public area: %v", index, err)
+    }
+
+    if pub.Attributes.NT != tpm2.TPMNTExtend {
+        return fmt.Errorf("NV index 0x%08x is not an extend index (type %v)", index, pub.Attributes.NT)
+    }
+    if !pub.Attributes.AuthWrite {
+        return fmt.Errorf("NV index 0x%08x does not allow writes with its auth value", index)
+    }
+    if pub.Attributes.WriteLocked {
+        return fmt.Errorf("NV index 0x%08x is write-locked", index)
+    }
+    return nil
+}
+
+// Extend data into an NV extend index.
+//
+// go-tpm doesn't wrap TPM2_NV_Extend yet, so the command is marshalled by
+// hand: the index authorizes itself through a password session with an
+// empty auth value, which validateNVIndex checked is allowed.
+func nvExtend(tpm transport.TPM, index uint32, data []byte) error {
+    auth, err := tpmutil.Pack(
+        tpmutil.Handle(tpm2.TPMRSPW), // session handle
+        tpmutil.U16Bytes(nil),        // nonce
+        byte(0),                      // session attributes
+        tpmutil.U16Bytes(nil),        // auth value
+    )
+    if err != nil {
+        return fmt.Errorf("failed to encode NV_Extend authorization: %v", err)
+    }
+
+    _, rc, err := tpmutil.RunCommand(transport.ToReadWriter(tpm),
+        tpmutil.Tag(tpm2.TPMSTSessions),
+        tpmutil.Command(tpm2.TPMCCNVExtend),
+        tpmutil.Handle(index), // auth handle
+        tpmutil.Handle(index), // NV index
+        tpmutil.U32Bytes(auth),
+        tpmutil.U16Bytes(data),
+    )
+    if err != nil {
+        return fmt.Errorf("NV_Extend of 0x%08x failed: %v", index, err)
+    }
+    if rc != tpmutil.RCSuccess {
+        return fmt.Errorf("NV_Extend of 0x%08x failed: %v", index, tpm2.TPMRC(rc))
+    }
+    return nil
+}
@@ -0,0 +1,132 @@
+package provisioner
+
+import (
+    "errors"
+    "fmt"
+    "log/slog"
+    "net/http"
+    "os"
+    "path/filepath"
+)
+
+// Body of a successful /validate, naming sent manifests by their file name
+type validateResponse struct {
+    Status    string   `json:"status"`
+    Manifests []string `json:"manifests"`
+}
+
+// Manifest validation handler: plays the stored manifests, or the ones
+// sent with the request, against the runtime without starting anything,
+// for catching manifest errors before /start
+func (s *Server) handleValidate(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    if !parseMultipart(w, r, s.cfg.MaxUploadBytes) {
+        return
+    }
+
+    // Validating plays the manifests, which pulls their images and may
+    // take a while. It must not race /start or touch the pods it started.
+    disableWriteTimeout(w)
+    s.startMu.Lock()
+    defer s.startMu.Unlock()
+    if s.state.isStarted() {
+        writeError(w, "pod already started", http.StatusConflict)
+        return
+    }
+
+    var manifests, names []string
+    if len(r.MultipartForm.File[podManifestField]) > 0 {
+        // Sent manifests are validated from temp files that never get
+        // measured or started
+        headers, err := formManifests(r.MultipartForm)
+        if err != nil {
+            writeError(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        var contents [][]byte
+        for _, header := range headers {
+            content, err := readFormFile(header, s.cfg.MaxUploadBytes)
+            if err != nil {
+                writeReadError(w, header.Filename, err)
+                return
+            }
+            if len(s.envelopeKeys) > 0 {
+                content, err = openEnvelope(content, s.envelopeKeys)
+                if errors.Is(err, errInvalidSignature) {
+                    writeError(w, fmt.Sprintf("%s: %v", header.Filename, err), http.StatusForbidden)
+                    return
+                } else if err != nil {
+                    writeError(w, fmt.Sprintf("%s: %v", header.Filename, err), http.StatusBadRequest)
+                    return
+                }
+            }
+            contents = append(contents, content)
+            names = append(names, header.Filename)
+        }
+
+        // Playing pulls the images, so a manifest /upload would refuse
+        // never gets that far
+        if !s.checkManifests(w, contents, names) {
+            return
+        }
+        for i, content := range contents {
+            path, err := writeValidationFile(s.cfg.ManifestDir, content)
+            if err != nil {
+                writeError(w, fmt.Sprintf("Failed to write %s: %v", names[i], err), http.StatusInternalServerError)
+                return
+            }
+            defer os.Remove(path)
+            manifests = append(manifests, path)
+        }
+    } else {
+        manifests = listPodManifests(s.cfg.ManifestDir)
+        if len(manifests) == 0 {
+            writeError(w, "pod.yaml not found", http.StatusNotFound)
+            return
+        }
+        names = manifests
+    }
+
+    if s.cfg.DryRun {
+        slog.Info("Dry run, not validating", "manifests", manifests)
+        writeJSON(w, http.StatusOK, validateResponse{Status: "dry-run", Manifests: names})
+        return
+    }
+
+    for i, manifest := range manifests {
+        err := s.runtime.Validate(manifest)
+        if errors.Is(err, errValidateTeardown) {
+            slog.Error("Failed to remove validated pods", "pod_path", manifest, "error", err)
+            writeError(w, fmt.Sprintf("Validated %s but failed to remove its pods:\n%v", filepath.Base(names[i]), err), http.StatusInternalServerError)
+            return
+        } else if err != nil {
+            slog.Info("Manifest validation failed", "pod_path", manifest, "error", err)
+            writeJSON(w, http.StatusUnprocessableEntity, startErrorResponse{
+                Error:  fmt.Sprintf("Validation failed for %s:\n%v", filepath.Base(names[i]), err),
+                Code:   http.StatusUnprocessableEntity,
+                Reason: startFailureReason(err),
+            })
+            return
+        }
+    }
+    writeJSON(w, http.StatusOK, validateResponse{Status: "valid", Manifests: names})
+}
+
+// Write a manifest sent for validation to a temp file in dir, next to the
+// stored ones, so the runtime resolves relative paths the same way
+func writeValidationFile(dir string, content []byte) (string, error) {
+    f, err := os.CreateTemp(dir, "validate-*.yaml")
+    if err != nil {
+        return "", err
+    }
+    defer f.Close()
+    if _, err := f.Write(content); err != nil {
+        os.Remove(f.Name())
+        return "", err
+    }
+    return f.Name(), nil
+}
@@ -0,0 +1,30 @@
+package provisioner
+
+import (
+    "context"
+    "fmt"
+    "os/exec"
+    "strings"
+)
+
+// Build information, injected at build time with e.g.
+//
+//    go build -ldflags "-X pod-provisioning-server/provisioner.version=v1.2.3 -X pod-provisioning-server/provisioner.gitCommit=$(git rev-parse HEAD) -X pod-provisioning-server/provisioner.buildDate=$(date -u +%FT%TZ)"
+var (
+    version   = "dev"
+    gitCommit = "unknown"
+    buildDate = "unknown"
+)
+
+// Version reported by `podman --version`, e.g. "4.9.3"
+func podmanVersion(ctx context.Context, podman string) (string, error) {
+    out, err := exec.CommandContext(ctx, podman, "--version").Output()
+    if err != nil {
+        return "", fmt.Errorf("failed to run %s --version: %v", podman, err)
+    }
+    fields := strings.Fields(string(out))
+    if len(fields) == 0 {
+        return "", fmt.Errorf("unexpected %s --version output %q", podman, out)
+    }
+    return fields[len(fields)-1], nil
+}